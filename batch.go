@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BatchOperation is a single operation of a batch request, either a
+// table request or, when raw queries are allowed, a sql statement with
+// its parameters. The id is a string or a number.
+type BatchOperation struct {
+	Name    string                 `json:"name"`
+	Method  string                 `json:"method"`
+	Table   string                 `json:"table"`
+	ID      interface{}            `json:"id"`
+	Filters map[string]interface{} `json:"filters"`
+	Body    json.RawMessage        `json:"body"`
+	SQL     string                 `json:"sql"`
+	Params  json.RawMessage        `json:"params"`
+}
+
+// BatchResult is the outcome of a single operation of a batch request
+type BatchResult struct {
+	Name     string      `json:"name,omitempty"`
+	Status   int         `json:"status"`
+	Location string      `json:"location,omitempty"`
+	Data     interface{} `json:"data"`
+}
+
+// batch handles POST {base}/_batch. The operations run in order inside
+// a single transaction, or a savepoint of the open transaction of the
+// request, which is rolled back as soon as one of them fails. A string
+// value of the form $step.column, where step is the name or the index of
+// an earlier operation, is replaced by that column of the first row the
+// operation returned; $$ escapes a literal $. The __timeout__ of the
+// batch request bounds the whole batch, and with __dry_run__ every
+// operation is a dry run.
+func batch(r *http.Request) (interface{}, *SqldError) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/json" {
+		return nil, BadRequest(errors.New("invalid content type"))
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	defer r.Body.Close()
+
+	// Numbers are kept as they are written, so that large ids and filter
+	// values keep all their digits
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var operations []BatchOperation
+	if err := decoder.Decode(&operations); err != nil {
+		return nil, BadRequest(err)
+	}
+	if len(operations) == 0 {
+		return nil, BadRequest(errors.New("empty batch"))
+	}
+
+	b := &batchRun{names: map[string]int{}}
+	err = runInTx(getExecutor(r), func(tx sqlx.Ext) error {
+		for i, op := range operations {
+			req, sqldErr := b.request(r, op)
+			if sqldErr == nil {
+				sqldErr = b.run(withExecutor(req, tx), op)
+			}
+			if sqldErr != nil {
+				label := strconv.Itoa(i)
+				if op.Name != "" {
+					label += " (" + op.Name + ")"
+				}
+				return NewError(fmt.Errorf("operation %s: %v", label, sqldErr.Err), sqldErr.Code)
+			}
+			if op.Name != "" {
+				b.names[op.Name] = i
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	return b.results, nil
+}
+
+// batchRun holds the results of the operations run so far
+type batchRun struct {
+	results []BatchResult
+	names   map[string]int
+}
+
+// request builds the http request of an operation, with the references
+// to earlier operations resolved
+func (b *batchRun) request(r *http.Request, op BatchOperation) (*http.Request, *SqldError) {
+	if op.SQL != "" {
+		if !config.AllowRaw {
+			return nil, NewError(errors.New("raw queries are not allowed"), http.StatusForbidden)
+		}
+		if op.Method != "" && !strings.EqualFold(op.Method, "POST") {
+			return nil, BadRequest(errors.New("sql operations use the POST method"))
+		}
+		if isDryRun(r) {
+			return nil, BadRequest(errors.New("sql operations cannot be dry run"))
+		}
+		params, sqldErr := b.resolveJson(op.Params)
+		if sqldErr != nil {
+			return nil, sqldErr
+		}
+		body, err := json.Marshal(RawQuery{SqlQuery: op.SQL, Params: params})
+		if err != nil {
+			return nil, InternalError(err)
+		}
+		return b.newRequest(r, "POST", config.Url, body)
+	}
+
+	if op.Table == "" {
+		return nil, BadRequest(errors.New("missing table"))
+	}
+	method := strings.ToUpper(op.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	target := config.Url + url.PathEscape(op.Table)
+	if op.ID != nil && op.ID != "" {
+		resolved, err := b.resolve(op.ID)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+		id, err := paramText(resolved)
+		if err != nil {
+			return nil, BadRequest(fmt.Errorf("invalid id: %w", err))
+		}
+		target += "/" + url.PathEscape(id)
+	}
+
+	query := url.Values{}
+	for key, value := range op.Filters {
+		if key == "__timeout__" {
+			return nil, BadRequest(errors.New("__timeout__ is set on the batch request, not on its operations"))
+		}
+		resolved, err := b.resolve(value)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+		items, ok := resolved.([]interface{})
+		if !ok {
+			items = []interface{}{resolved}
+		}
+		for _, item := range items {
+			text, err := paramText(item)
+			if err != nil {
+				return nil, BadRequest(fmt.Errorf("invalid filter %s: %w", key, err))
+			}
+			query.Add(key, text)
+		}
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	body, sqldErr := b.resolveJson(op.Body)
+	if sqldErr != nil {
+		return nil, sqldErr
+	}
+	return b.newRequest(r, method, target, body)
+}
+
+// resolveJson resolves the references in a json document
+func (b *batchRun) resolveJson(doc json.RawMessage) (json.RawMessage, *SqldError) {
+	if len(doc) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, BadRequest(err)
+	}
+	resolved, err := b.resolve(value)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	resolvedDoc, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, InternalError(err)
+	}
+	return resolvedDoc, nil
+}
+
+// newRequest creates the request of an operation. It carries the
+// context of the batch request so that a cancelled batch stops.
+func (b *batchRun) newRequest(r *http.Request, method, target string, body []byte) (*http.Request, *SqldError) {
+	req, err := http.NewRequestWithContext(r.Context(), method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if isDryRun(r) {
+		req.Header.Set("Prefer", "dry-run")
+	}
+	return req, nil
+}
+
+// paramText returns the text of a value used as an id or a query
+// parameter, numbers being written out in full
+func paramText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case map[string]interface{}, []interface{}:
+		return "", errors.New("expected a string or a number")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// run executes an operation and records its result
+func (b *batchRun) run(r *http.Request, op BatchOperation) *SqldError {
+	var data interface{}
+	var sqldErr *SqldError
+	if op.SQL != "" {
+		data, sqldErr = raw(r)
+	} else {
+		data, sqldErr = route(r)
+	}
+	if sqldErr != nil {
+		return sqldErr
+	}
+
+	result := BatchResult{Name: op.Name, Status: http.StatusOK, Data: data}
+	if created, ok := data.(Created); ok {
+		result.Status = http.StatusCreated
+		result.Location = created.Location
+		result.Data = created.Data
+	}
+	b.results = append(b.results, result)
+	return nil
+}
+
+// resolve replaces the references to earlier operations in a decoded
+// json value
+func (b *batchRun) resolve(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return b.reference(v)
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if resolved[i], err = b.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return resolved, nil
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if resolved[key], err = b.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return resolved, nil
+	}
+	return value, nil
+}
+
+// reference returns the value a $step.column string refers to, other
+// strings are returned as they are
+func (b *batchRun) reference(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "$$") {
+		return s[1:], nil
+	}
+	if !strings.HasPrefix(s, "$") {
+		return s, nil
+	}
+
+	step, column, found := strings.Cut(s[1:], ".")
+	if !found || step == "" || column == "" {
+		return nil, fmt.Errorf("invalid reference %s: expected $step.column", s)
+	}
+	index, ok := b.names[step]
+	if !ok {
+		var err error
+		index, err = strconv.Atoi(step)
+		if err != nil || index < 0 || index >= len(b.results) {
+			return nil, fmt.Errorf("invalid reference %s: unknown operation %s", s, step)
+		}
+	}
+
+	var row Row
+	switch data := b.results[index].Data.(type) {
+	case Row:
+		row = data
+	case ResultSet:
+		if len(data.Rows) > 0 {
+			row = data.Rows[0]
+		}
+	}
+	if row.Columns == nil {
+		return nil, fmt.Errorf("invalid reference %s: operation %s returned no row", s, step)
+	}
+	value, ok := row.Get(column)
+	if !ok {
+		return nil, fmt.Errorf("invalid reference %s: operation %s has no column %s", s, step, column)
+	}
+	return value, nil
+}
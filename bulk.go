@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+)
+
+// BulkResult reports the rows inserted by a bulk POST, per batch, when
+// the database cannot return the inserted rows
+type BulkResult struct {
+	RowsAffected int64   `json:"rows_affected"`
+	Batches      []int64 `json:"batches"`
+}
+
+// insertBatch is a set of items sharing the same columns, small enough
+// to be inserted by a single statement
+type insertBatch struct {
+	columns []string
+	items   []map[string]interface{}
+}
+
+// createMany handles the POST method when an array of models is
+// provided in the request body. The items are inserted with multi-row
+// INSERT statements in a single transaction.
+func createMany(ex sqlx.Ext, table string, items []map[string]interface{}, params map[string][]string) (interface{}, error) {
+	if len(items) == 0 {
+		return nil, BadRequest(errors.New("empty request"))
+	}
+
+	info, err := lookupTable(contextOf(ex), table)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := buildBulkQueries(info, items, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var inserted ResultSet
+	var result BulkResult
+	err = runInTx(ex, func(tx sqlx.Ext) error {
+		for _, query := range queries {
+			sql, args, err := query.ToSql()
+			if err != nil {
+				return err
+			}
+
+			if supportsReturning() {
+				rows, err := readQuery(tx, sql, args)
+				if err != nil {
+					return err
+				}
+				inserted.Columns = rows.Columns
+				inserted.Rows = append(inserted.Rows, rows.Rows...)
+				continue
+			}
+
+			res, err := tx.Exec(sql, args...)
+			if err != nil {
+				return err
+			}
+			rowsAffected, _ := res.RowsAffected()
+			result.RowsAffected += rowsAffected
+			result.Batches = append(result.Batches, rowsAffected)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if supportsReturning() {
+		return Created{Data: inserted}, nil
+	}
+	return Created{Data: result}, nil
+}
+
+// buildBulkQueries builds the multi-row INSERT statements of a bulk
+// insert, including the upsert clause and, when supported, RETURNING *
+func buildBulkQueries(info *TableInfo, items []map[string]interface{}, params map[string][]string) ([]squirrel.InsertBuilder, error) {
+	qualifiedTable := config.GetTableName(info.Name)
+
+	var queries []squirrel.InsertBuilder
+	for _, batch := range insertBatches(items) {
+		columns := make([]string, len(batch.columns))
+		for i, column := range batch.columns {
+			quoted, err := info.QuoteColumn(column)
+			if err != nil {
+				return nil, err
+			}
+			columns[i] = quoted
+		}
+
+		query := sq.Insert(qualifiedTable).Columns(columns...)
+		for _, item := range batch.items {
+			values := make([]interface{}, len(batch.columns))
+			for i, column := range batch.columns {
+				values[i] = item[column]
+			}
+			query = query.Values(values...)
+		}
+
+		upsert, err := upsertClause(info, params, batch.columns)
+		if err != nil {
+			return nil, err
+		}
+		if upsert != "" {
+			query = query.Suffix(upsert)
+		}
+		if supportsReturning() {
+			query = query.Suffix("RETURNING *")
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// insertBatches groups consecutive items with the same columns and
+// splits the groups so that no statement exceeds the placeholder limit
+func insertBatches(items []map[string]interface{}) []insertBatch {
+	var batches []insertBatch
+	var current *insertBatch
+	currentKey := ""
+
+	for _, item := range items {
+		columns := make([]string, 0, len(item))
+		for column := range item {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		key := strings.Join(columns, "\x00")
+
+		maxRows := maxPlaceholders() / max(len(columns), 1)
+		if current == nil || key != currentKey || len(current.items) >= maxRows {
+			batches = append(batches, insertBatch{columns: columns})
+			current = &batches[len(batches)-1]
+			currentKey = key
+		}
+		current.items = append(current.items, item)
+	}
+	return batches
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"strings"
+)
+
+// Statement kinds of the raw endpoint
+const (
+	readStatement  = "read"
+	writeStatement = "write"
+	ddlStatement   = "ddl"
+)
+
+// statementKinds maps the leading keyword of a statement onto its kind
+var statementKinds = map[string]string{
+	"SELECT":   readStatement,
+	"VALUES":   readStatement,
+	"TABLE":    readStatement,
+	"SHOW":     readStatement,
+	"DESCRIBE": readStatement,
+	"DESC":     readStatement,
+	"EXPLAIN":  readStatement,
+	"PRAGMA":   readStatement,
+	"INSERT":   writeStatement,
+	"UPDATE":   writeStatement,
+	"DELETE":   writeStatement,
+	"REPLACE":  writeStatement,
+	"MERGE":    writeStatement,
+	"CALL":     writeStatement,
+	"CREATE":   ddlStatement,
+	"DROP":     ddlStatement,
+	"ALTER":    ddlStatement,
+	"TRUNCATE": ddlStatement,
+	"RENAME":   ddlStatement,
+	"COMMENT":  ddlStatement,
+	"GRANT":    ddlStatement,
+	"REVOKE":   ddlStatement,
+	"REINDEX":  ddlStatement,
+	"VACUUM":   ddlStatement,
+	"ANALYZE":  ddlStatement,
+	"ATTACH":   ddlStatement,
+	"DETACH":   ddlStatement,
+}
+
+// Statement is the classification of a sql statement
+type Statement struct {
+	Kind        string // read, write or ddl, empty when unknown
+	ReturnsRows bool
+}
+
+// sqlToken is a keyword, an identifier or a punctuation character of a
+// statement along with its parenthesis depth. Words are upper cased.
+type sqlToken struct {
+	text  string
+	depth int
+}
+
+// classifyStatement determines the kind of a sql statement and whether it
+// returns rows. Comments and literals are skipped, a WITH clause is looked
+// through to the main statement, and a data modifying CTE or a RETURNING
+// clause is taken into account.
+func classifyStatement(query string) Statement {
+	tokens := tokenize(query)
+
+	// Skip the parentheses of e.g. (SELECT 1) UNION (SELECT 2)
+	pos := 0
+	for pos < len(tokens) && tokens[pos].text == "(" {
+		pos++
+	}
+
+	modifies := false
+	if pos < len(tokens) && tokens[pos].text == "WITH" {
+		pos, modifies = skipWith(tokens, pos+1)
+	}
+	if pos >= len(tokens) {
+		return Statement{}
+	}
+
+	keyword := tokens[pos].text
+	depth := tokens[pos].depth
+	rest := tokens[pos+1:]
+	stmt := Statement{Kind: statementKinds[keyword]}
+
+	switch stmt.Kind {
+	case readStatement:
+		stmt.ReturnsRows = true
+		switch keyword {
+		case "SELECT":
+			// SELECT ... INTO creates a table or writes a file
+			if hasWord(rest, depth, "INTO") {
+				stmt.Kind = ddlStatement
+				stmt.ReturnsRows = false
+			}
+		case "EXPLAIN":
+			// EXPLAIN ANALYZE runs the explained statement
+			if analyzed := explainedKind(rest); analyzed != "" {
+				stmt.Kind = analyzed
+			}
+		case "PRAGMA":
+			if hasWord(rest, depth, "=") {
+				stmt.Kind = ddlStatement
+			}
+		}
+	case writeStatement:
+		stmt.ReturnsRows = hasWord(rest, depth, "RETURNING")
+	}
+
+	if modifies && stmt.Kind == readStatement {
+		stmt.Kind = writeStatement
+	}
+	return stmt
+}
+
+// skipWith skips the common table expressions of a WITH clause and
+// returns the position of the main statement, along with whether one of
+// the expressions modifies data
+func skipWith(tokens []sqlToken, pos int) (int, bool) {
+	modifies := false
+	if pos < len(tokens) && tokens[pos].text == "RECURSIVE" {
+		pos++
+	}
+	for pos < len(tokens) {
+		// name [(columns)] AS [NOT] [MATERIALIZED] (query)
+		pos++
+		if pos < len(tokens) && tokens[pos].text == "(" {
+			pos = closingParen(tokens, pos) + 1
+		}
+		for pos < len(tokens) && tokens[pos].text != "(" {
+			pos++
+		}
+		if pos+1 < len(tokens) && statementKinds[tokens[pos+1].text] == writeStatement {
+			modifies = true
+		}
+		pos = closingParen(tokens, pos) + 1
+		if pos >= len(tokens) || tokens[pos].text != "," {
+			break
+		}
+		pos++
+	}
+	return pos, modifies
+}
+
+// closingParen returns the position of the parenthesis closing the one
+// at pos
+func closingParen(tokens []sqlToken, pos int) int {
+	if pos >= len(tokens) {
+		return pos
+	}
+	depth := tokens[pos].depth
+	for i := pos + 1; i < len(tokens); i++ {
+		if tokens[i].text == ")" && tokens[i].depth == depth {
+			return i
+		}
+	}
+	return len(tokens)
+}
+
+// explainedKind returns the kind of the statement explained by an
+// EXPLAIN ANALYZE, or an empty string when the statement is not run
+func explainedKind(tokens []sqlToken) string {
+	analyze := false
+	for _, token := range tokens {
+		if token.text == "ANALYZE" {
+			analyze = true
+			continue
+		}
+		if kind, ok := statementKinds[token.text]; ok && token.text != "EXPLAIN" {
+			if !analyze {
+				return ""
+			}
+			return kind
+		}
+	}
+	return ""
+}
+
+// hasWord reports whether a token appears at the given depth
+func hasWord(tokens []sqlToken, depth int, word string) bool {
+	for _, token := range tokens {
+		if token.depth == depth && token.text == word {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize splits the first statement of a query into tokens, skipping
+// whitespace, comments, literals and quoted identifiers
+func tokenize(query string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	for i := 0; i < len(query); {
+		if end := scanLiteral(query, i); end > i {
+			i = end
+			continue
+		}
+
+		c := query[i]
+		switch {
+		case isWordStart(c):
+			start := i
+			for i < len(query) && isWordChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{strings.ToUpper(query[start:i]), depth})
+			continue
+		case c == '(':
+			tokens = append(tokens, sqlToken{"(", depth})
+			depth++
+		case c == ')':
+			depth--
+			tokens = append(tokens, sqlToken{")", depth})
+		case c == ',' || c == '=':
+			tokens = append(tokens, sqlToken{string(c), depth})
+		case c == ';' && depth == 0:
+			return tokens
+		}
+		i++
+	}
+	return tokens
+}
+
+// scanLiteral returns the position after the comment, string literal or
+// quoted identifier starting at position i of the query, or i when none
+// starts there. An unterminated literal runs to the end of the query.
+// MySQL runs the text of a /*! comment, only its opening is skipped.
+func scanLiteral(query string, i int) int {
+	rest := query[i:]
+	switch {
+	case strings.HasPrefix(rest, "/*!") && config.Dbtype == "mysql":
+		end := 3
+		for end < len(rest) && isDigit(rest[end]) {
+			end++
+		}
+		return i + end
+	case strings.HasPrefix(rest, "--"), rest[0] == '#' && config.Dbtype == "mysql":
+		if end := strings.IndexByte(rest, '\n'); end >= 0 {
+			return i + end + 1
+		}
+		return len(query)
+	case strings.HasPrefix(rest, "/*"):
+		if end := strings.Index(rest[2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(query)
+	case rest[0] == '\'' || rest[0] == '"' || rest[0] == '`':
+		return scanQuoted(query, i, rest[0])
+	case rest[0] == '$' && config.Dbtype == "postgres":
+		// Dollar quoted string, $$...$$ or $tag$...$tag$
+		tagEnd := 1
+		for tagEnd < len(rest) && (isWordStart(rest[tagEnd]) || (tagEnd > 1 && isDigit(rest[tagEnd]))) {
+			tagEnd++
+		}
+		if tagEnd >= len(rest) || rest[tagEnd] != '$' {
+			return i
+		}
+		tag := rest[:tagEnd+1]
+		if end := strings.Index(rest[len(tag):], tag); end >= 0 {
+			return i + len(tag) + end + len(tag)
+		}
+		return len(query)
+	}
+	return i
+}
+
+// scanQuoted returns the position after the quoted text starting at
+// position i. A doubled quote is an escaped quote, MySQL also escapes
+// with a backslash.
+func scanQuoted(query string, i int, quote byte) int {
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if config.Dbtype == "mysql" && quote != '`' {
+				j++
+			}
+		case quote:
+			if j+1 < len(query) && query[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// isWordStart reports whether c starts a keyword or an identifier
+func isWordStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// isWordChar reports whether c belongs to a keyword or an identifier
+func isWordChar(c byte) bool {
+	return isWordStart(c) || isDigit(c) || c == '$'
+}
+
+// isDigit reports whether c is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
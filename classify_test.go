@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		dbtype      string
+		query       string
+		kind        string
+		returnsRows bool
+	}{
+		{"sqlite3", "SELECT 1", readStatement, true},
+		{"sqlite3", "select * from t", readStatement, true},
+		{"sqlite3", "(SELECT 1) UNION (SELECT 2)", readStatement, true},
+		{"sqlite3", "VALUES (1), (2)", readStatement, true},
+		{"sqlite3", "INSERT INTO t VALUES (1)", writeStatement, false},
+		{"sqlite3", "INSERT INTO t VALUES ('RETURNING')", writeStatement, false},
+		{"sqlite3", "DELETE FROM t RETURNING id", writeStatement, true},
+		{"sqlite3", "UPDATE/**/t SET x = 1", writeStatement, false},
+		{"sqlite3", "CALL p()", writeStatement, false},
+		{"sqlite3", "CREATE TABLE t (x int)", ddlStatement, false},
+		{"sqlite3", "ATTACH DATABASE 'other.db' AS other", ddlStatement, false},
+		{"sqlite3", "VACUUM", ddlStatement, false},
+		{"sqlite3", "", "", false},
+		{"sqlite3", "-- only a comment", "", false},
+		{"sqlite3", "BEGIN", "", false},
+
+		// Statements hidden behind comments
+		{"sqlite3", "-- SELECT\nDELETE FROM t", writeStatement, false},
+		{"sqlite3", "/* SELECT */ DROP TABLE t", ddlStatement, false},
+		{"sqlite3", "/* DELETE */ SELECT 1", readStatement, true},
+		{"sqlite3", "  -- DELETE FROM t\n  SELECT 1", readStatement, true},
+		{"mysql", "# SELECT\nDELETE FROM t", writeStatement, false},
+		{"mysql", "/*!50000 DELETE */ SELECT 1", writeStatement, false},
+		{"mysql", "/*! DROP TABLE t */", ddlStatement, false},
+		{"mysql", "/* DROP TABLE t */ SELECT 1", readStatement, true},
+
+		// Writable common table expressions
+		{"postgres", "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", writeStatement, true},
+		{"postgres", "WITH a AS (SELECT 1), b AS (UPDATE t SET x = 1 RETURNING x) SELECT * FROM b", writeStatement, true},
+		{"postgres", "WITH a (x) AS NOT MATERIALIZED (INSERT INTO t VALUES (1) RETURNING x) SELECT x FROM a", writeStatement, true},
+		{"postgres", "WITH a AS (SELECT 1) DELETE FROM t", writeStatement, false},
+		{"sqlite3", "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT x FROM c", readStatement, true},
+		{"sqlite3", "WITH a AS (SELECT 'DELETE') SELECT * FROM a", readStatement, true},
+
+		// EXPLAIN ANALYZE runs the explained statement
+		{"postgres", "EXPLAIN SELECT 1", readStatement, true},
+		{"postgres", "EXPLAIN DELETE FROM t", readStatement, true},
+		{"postgres", "EXPLAIN ANALYZE SELECT 1", readStatement, true},
+		{"postgres", "EXPLAIN ANALYZE DELETE FROM t", writeStatement, true},
+		{"postgres", "explain analyze insert into t values (1)", writeStatement, true},
+		{"postgres", "EXPLAIN (ANALYZE, BUFFERS) UPDATE t SET x = 1", writeStatement, true},
+		{"mysql", "EXPLAIN ANALYZE DELETE FROM t", writeStatement, true},
+		{"sqlite3", "EXPLAIN QUERY PLAN DELETE FROM t", readStatement, true},
+
+		// SELECT ... INTO creates a table or writes a file
+		{"postgres", "SELECT * INTO backup FROM t", ddlStatement, false},
+		{"mysql", "SELECT * FROM t INTO OUTFILE '/tmp/t.csv'", ddlStatement, false},
+		{"postgres", "SELECT 'INTO' AS x FROM t", readStatement, true},
+		{"postgres", `SELECT "into" FROM t`, readStatement, true},
+
+		// PRAGMA with a value changes the database
+		{"sqlite3", "PRAGMA table_info(t)", readStatement, true},
+		{"sqlite3", "PRAGMA journal_mode", readStatement, true},
+		{"sqlite3", "PRAGMA journal_mode = WAL", ddlStatement, true},
+		{"sqlite3", "PRAGMA writable_schema=1", ddlStatement, true},
+		{"sqlite3", "pragma main.user_version = 7", ddlStatement, true},
+
+		// Delimiters and keywords inside literals
+		{"sqlite3", "SELECT ';DELETE FROM t'", readStatement, true},
+		{"sqlite3", "SELECT 'it''s'; DELETE FROM t", readStatement, true},
+		{"sqlite3", `SELECT "a;b" FROM t`, readStatement, true},
+		{"mysql", `SELECT 'it\'s; DELETE' FROM t`, readStatement, true},
+		{"mysql", "SELECT `DELETE` FROM t", readStatement, true},
+		{"postgres", "SELECT $$;DELETE FROM t$$", readStatement, true},
+		{"postgres", "SELECT $body$ DELETE $$ $body$", readStatement, true},
+	}
+
+	defer func(dbtype string) { config.Dbtype = dbtype }(config.Dbtype)
+	for _, test := range tests {
+		config.Dbtype = test.dbtype
+		stmt := classifyStatement(test.query)
+		if stmt.Kind != test.kind || stmt.ReturnsRows != test.returnsRows {
+			t.Errorf("%s: classifyStatement(%q) = %q, %v, want %q, %v",
+				test.dbtype, test.query, stmt.Kind, stmt.ReturnsRows, test.kind, test.returnsRows)
+		}
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/subosito/gotenv"
 )
 
+// Raw modes, each allowing the statements of the previous one
+const (
+	rawModeReadonly  = "readonly"  // reads only
+	rawModeReadwrite = "readwrite" // reads and data changes
+	rawModeDdl       = "ddl"       // reads, data and schema changes
+)
+
 const (
 	mysqlDSNTemplate       = "%s:%s@(%s)/%s?parseTime=true"
 	postgresDSNTemplate    = "postgres://%s:%s@%s/%s?sslmode=disable"
@@ -30,6 +38,17 @@ type Config struct {
 	HealthCheckUrl     string // health check url
 	HealthCheckInteval int    // health check interval
 	Debug              bool   // debug mode
+
+	PrimaryKeys     map[string][]string // primary key columns per table, overrides the catalog
+	AllowUnfiltered bool                // allow updates and deletes without a filter when __all__=true
+	MaxAffected     int64               // maximum rows an update or delete may affect, 0 for no limit
+	TxTimeout       time.Duration       // idle time after which an open transaction is rolled back
+	MaxTx           int                 // maximum number of concurrently open transactions
+	RawMode         string              // statements allowed in raw queries: readonly, readwrite or ddl
+	QueryTimeout    time.Duration       // maximum time the queries of a request may take, 0 for no limit
+	BigNumStrings   bool                // encode decimals and integers beyond 2^53 as json strings
+	ConfigFile      string              // config file holding the saved queries
+	Queries         map[string]*SavedQuery
 }
 
 // Order of precedence: command line flag > .env file > environment variable > default value
@@ -60,6 +79,15 @@ func parseConfig() Config {
 	v.SetDefault("healthcheckurl", "")
 	v.SetDefault("healthcheckinterval", 1)
 	v.SetDefault("debug", false)
+	v.SetDefault("primarykeys", []string{})
+	v.SetDefault("allowunfiltered", false)
+	v.SetDefault("maxaffected", 0)
+	v.SetDefault("txtimeout", 30*time.Second)
+	v.SetDefault("maxtx", 10)
+	v.SetDefault("rawmode", rawModeDdl)
+	v.SetDefault("configfile", "")
+	v.SetDefault("querytimeout", 0)
+	v.SetDefault("bignumbersasstrings", false)
 
 	// Bind environment variables
 	v.AutomaticEnv()
@@ -76,6 +104,15 @@ func parseConfig() Config {
 	v.BindEnv("healthcheckurl", "HEALTH_CHECK_URL")
 	v.BindEnv("healthcheckinterval", "HEALTH_CHECK_INTERVAL")
 	v.BindEnv("debug", "DEBUG")
+	v.BindEnv("primarykeys", "PRIMARY_KEYS")
+	v.BindEnv("allowunfiltered", "ALLOW_UNFILTERED")
+	v.BindEnv("maxaffected", "MAX_AFFECTED")
+	v.BindEnv("txtimeout", "TX_TIMEOUT")
+	v.BindEnv("maxtx", "MAX_TX")
+	v.BindEnv("rawmode", "RAW_MODE")
+	v.BindEnv("configfile", "CONFIG_FILE")
+	v.BindEnv("querytimeout", "QUERY_TIMEOUT")
+	v.BindEnv("bignumbersasstrings", "BIG_NUMBERS_AS_STRINGS")
 
 	// Define flags
 	pflag.Bool("raw", v.GetBool("allowraw"), "allow raw sql queries")
@@ -91,6 +128,15 @@ func parseConfig() Config {
 	pflag.String("healthCheckUrl", v.GetString("healthcheckurl"), "health check url")
 	pflag.Int("healthCheckInterval", v.GetInt("healthcheckinterval"), "health check interval (minutes)")
 	pflag.Bool("debug", v.GetBool("debug"), "debug mode")
+	pflag.StringArray("pk", v.GetStringSlice("primarykeys"), "primary key columns of a table, e.g. order_items=order_id,item_id (repeatable)")
+	pflag.Bool("allow-unfiltered", v.GetBool("allowunfiltered"), "allow updates and deletes without a filter when __all__=true")
+	pflag.Int64("max-affected", v.GetInt64("maxaffected"), "maximum rows an update or delete may affect, 0 for no limit")
+	pflag.Duration("tx-timeout", v.GetDuration("txtimeout"), "idle time after which an open transaction is rolled back")
+	pflag.Int("max-tx", v.GetInt("maxtx"), "maximum number of concurrently open transactions")
+	pflag.String("raw-mode", v.GetString("rawmode"), "statements allowed in raw queries: readonly, readwrite or ddl")
+	pflag.String("config", v.GetString("configfile"), "config file (yaml, json or toml) holding the saved queries")
+	pflag.Duration("query-timeout", v.GetDuration("querytimeout"), "maximum time the queries of a request may take, 0 for no limit")
+	pflag.Bool("big-numbers-as-strings", v.GetBool("bignumbersasstrings"), "encode decimals and integers beyond 2^53 as json strings")
 
 	pflag.Parse()
 
@@ -111,7 +157,32 @@ func parseConfig() Config {
 		HealthCheckUrl:     v.GetString("healthCheckUrl"),
 		HealthCheckInteval: v.GetInt("healthCheckInterval"),
 		Debug:              v.GetBool("debug"),
+		PrimaryKeys:        parsePrimaryKeys(v.GetStringSlice("pk")),
+		AllowUnfiltered:    v.GetBool("allow-unfiltered"),
+		MaxAffected:        v.GetInt64("max-affected"),
+		TxTimeout:          v.GetDuration("tx-timeout"),
+		MaxTx:              v.GetInt("max-tx"),
+		RawMode:            v.GetString("raw-mode"),
+		ConfigFile:         v.GetString("config"),
+		QueryTimeout:       v.GetDuration("query-timeout"),
+		BigNumStrings:      v.GetBool("big-numbers-as-strings"),
+	}
+}
+
+// parsePrimaryKeys parses the primary key overrides, each entry is
+// table=col1,col2 and several entries can be separated by a semicolon
+func parsePrimaryKeys(entries []string) map[string][]string {
+	keys := map[string][]string{}
+	for _, entry := range entries {
+		for _, override := range strings.Split(entry, ";") {
+			table, columns, found := strings.Cut(strings.TrimSpace(override), "=")
+			if !found || table == "" || columns == "" {
+				continue
+			}
+			keys[table] = strings.Split(columns, ",")
+		}
 	}
+	return keys
 }
 
 // Add slash to the end of the url and add slash to the beginning of the url
@@ -179,6 +250,15 @@ Options:
   -raw, --allowRaw     Allow raw SQL queries (default: false)
   -healthCheckUrl      Health check URL (default: http://localhost:8080/health)
   -healthCheckInterval Health check interval in minutes (default: 1)
+  -pk                  Primary key columns of a table, e.g. order_items=order_id,item_id (repeatable)
+  -allow-unfiltered    Allow updates and deletes without a filter when __all__=true (default: false)
+  -max-affected        Maximum rows an update or delete may affect, 0 for no limit (default: 0)
+  -tx-timeout          Idle time after which an open transaction is rolled back (default: 30s)
+  -max-tx              Maximum number of concurrently open transactions (default: 10)
+  -raw-mode            Statements allowed in raw queries: readonly, readwrite or ddl (default: ddl)
+  -config              Config file (yaml, json or toml) holding the saved queries
+  -query-timeout       Maximum time the queries of a request may take, 0 for no limit (default: 0)
+  -big-numbers-as-strings Encode decimals and integers beyond 2^53 as JSON strings (default: false)
   -debug               Debug mode (default: false)
   -v                   Print version and exit
   
@@ -198,6 +278,16 @@ func HandleFlags() Config {
 	config := parseConfig()
 	config.fixUrl()
 	config.buildDSN()
+	switch config.RawMode {
+	case rawModeReadonly, rawModeReadwrite, rawModeDdl:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid raw mode %s, expected readonly, readwrite or ddl\n", config.RawMode)
+		os.Exit(1)
+	}
+	if config.TxTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid tx timeout %s, expected a positive duration\n", config.TxTimeout)
+		os.Exit(1)
+	}
 	return config
 }
 
@@ -215,6 +305,15 @@ func (config *Config) print() {
 	fmt.Println("Url:", config.Url)
 	fmt.Println("HealthCheckUrl:", config.HealthCheckUrl)
 	fmt.Println("HealthCheckInteval:", config.HealthCheckInteval)
+	fmt.Println("PrimaryKeys:", config.PrimaryKeys)
+	fmt.Println("AllowUnfiltered:", config.AllowUnfiltered)
+	fmt.Println("MaxAffected:", config.MaxAffected)
+	fmt.Println("TxTimeout:", config.TxTimeout)
+	fmt.Println("MaxTx:", config.MaxTx)
+	fmt.Println("RawMode:", config.RawMode)
+	fmt.Println("ConfigFile:", config.ConfigFile)
+	fmt.Println("QueryTimeout:", config.QueryTimeout)
+	fmt.Println("BigNumStrings:", config.BigNumStrings)
 }
 
 // IsBaseUrl returns true if the url is the same as the base url or
@@ -223,29 +322,37 @@ func (c *Config) IsBaseUrl(url string) bool {
 	return url == c.Url || url+"/" == c.Url
 }
 
-// GetTableName returns the fully qualified table name for the database type
-// For PostgreSQL, it includes schema prefix if not using public schema
-// and properly quotes table names that contain uppercase letters
-func (c *Config) GetTableName(tableName string) string {
-	if c.Dbtype == "postgres" {
-		// Check if table name contains uppercase letters - if so, it needs to be quoted
-		hasUppercase := false
-		for _, r := range tableName {
-			if r >= 'A' && r <= 'Z' {
-				hasUppercase = true
-				break
-			}
-		}
+// AllowsStatement reports whether the raw mode allows a statement of the
+// given kind
+func (c *Config) AllowsStatement(kind string) bool {
+	switch c.RawMode {
+	case rawModeReadonly:
+		return kind == readStatement
+	case rawModeReadwrite:
+		return kind == readStatement || kind == writeStatement
+	case rawModeDdl:
+		return true
+	}
+	return false
+}
 
-		// Quote the table name if it has uppercase letters
-		if hasUppercase {
-			tableName = fmt.Sprintf("\"%s\"", tableName)
-		}
+// QuoteIdent quotes an identifier for the database type, doubling any
+// embedded quote character: backticks for MySQL and double quotes for
+// PostgreSQL and SQLite
+func (c *Config) QuoteIdent(name string) string {
+	if c.Dbtype == "mysql" {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
 
-		// Add schema prefix if not using public schema
-		if c.Schema != "" && c.Schema != "public" {
-			return fmt.Sprintf("%s.%s", c.Schema, tableName)
-		}
+// GetTableName returns the fully qualified, quoted table name for the
+// database type. For PostgreSQL, it includes the schema prefix if not
+// using the public schema
+func (c *Config) GetTableName(tableName string) string {
+	quoted := c.QuoteIdent(tableName)
+	if c.Dbtype == "postgres" && c.Schema != "" && c.Schema != "public" {
+		return fmt.Sprintf("%s.%s", c.QuoteIdent(c.Schema), quoted)
 	}
-	return tableName
+	return quoted
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DryRun reports the SQL a request would run along with the query plan
+// of the database, without running it
+type DryRun struct {
+	SQL  string        `json:"sql"`
+	Args []interface{} `json:"args"`
+	Plan ResultSet     `json:"plan"`
+}
+
+// isDryRun reports whether the request asks for a dry run, either with
+// __dry_run__=true or with a Prefer: dry-run header
+func isDryRun(r *http.Request) bool {
+	if dryRun, ok := r.URL.Query()["__dry_run__"]; ok && dryRun[0] == "true" {
+		return true
+	}
+	_, ok := preference(r, "dry-run")
+	return ok
+}
+
+// explain returns the statement that shows the query plan of sql. Plain
+// EXPLAIN does not run the statement on PostgreSQL and MySQL, SQLite
+// needs EXPLAIN QUERY PLAN for a readable plan.
+func explain(sql string) string {
+	if config.Dbtype == "sqlite3" {
+		return "EXPLAIN QUERY PLAN " + sql
+	}
+	return "EXPLAIN " + sql
+}
+
+// dryRun answers a dry run request with the generated SQL and its plan
+func dryRun(ex sqlx.Queryer, sql string, args []interface{}) (interface{}, *SqldError) {
+	plan, err := readQuery(ex, explain(sql), args)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	return DryRun{SQL: sql, Args: args, Plan: plan}, nil
+}
+
+// dryRunInsert answers a dry run POST with the INSERT statements that
+// would be run for the items
+func dryRunInsert(ex sqlx.Queryer, table string, items []map[string]interface{}, params map[string][]string) (interface{}, *SqldError) {
+	info, err := lookupTable(contextOf(ex), table)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	queries, err := buildBulkQueries(info, items, params)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+
+	var results []DryRun
+	for _, query := range queries {
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+		result, sqldErr := dryRun(ex, sql, args)
+		if sqldErr != nil {
+			return nil, sqldErr
+		}
+		results = append(results, result.(DryRun))
+	}
+
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return results, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// executorKey is the request context key of the executor of a request
+// running in a transaction
+type executorKey struct{}
+
+// executor runs the queries of a request on the database or on a
+// transaction with the context of the request, so that they stop when
+// the request is cancelled or times out. Inside a transaction, depth is
+// the number of savepoints the queries run in.
+type executor struct {
+	sqlx.ExtContext
+	ctx   context.Context
+	depth int
+}
+
+// Query runs a query with the context of the request
+func (e executor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.QueryContext(e.ctx, query, args...)
+}
+
+// Queryx runs a query with the context of the request
+func (e executor) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return e.QueryxContext(e.ctx, query, args...)
+}
+
+// QueryRowx runs a query returning a single row with the context of the
+// request
+func (e executor) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return e.QueryRowxContext(e.ctx, query, args...)
+}
+
+// Exec runs a statement with the context of the request
+func (e executor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.ExecContext(e.ctx, query, args...)
+}
+
+// withExecutor returns a shallow copy of the request whose queries run
+// in the given transaction, or in the transaction of the given executor
+// along with its savepoints
+func withExecutor(r *http.Request, ex sqlx.Ext) *http.Request {
+	e, ok := ex.(executor)
+	if !ok {
+		e = executor{ExtContext: ex.(sqlx.ExtContext)}
+	}
+	return r.WithContext(context.WithValue(r.Context(), executorKey{}, e))
+}
+
+// getExecutor returns the executor of the request, running in the
+// transaction of the request or on the database when the request is not
+// part of a transaction
+func getExecutor(r *http.Request) sqlx.Ext {
+	if e, ok := r.Context().Value(executorKey{}).(executor); ok {
+		e.ctx = r.Context()
+		return e
+	}
+	return executor{ExtContext: db, ctx: r.Context()}
+}
+
+// txOf returns the transaction an executor runs in
+func txOf(ex sqlx.Ext) (*sqlx.Tx, bool) {
+	if e, ok := ex.(executor); ok {
+		tx, ok := e.ExtContext.(*sqlx.Tx)
+		return tx, ok
+	}
+	return nil, false
+}
+
+// contextOf returns the context of the request an executor runs for
+func contextOf(ex sqlx.Queryer) context.Context {
+	if e, ok := ex.(executor); ok {
+		return e.ctx
+	}
+	return context.Background()
+}
+
+// newTx begins a transaction on the database with the context of the
+// executor, and returns it along with an executor running in it
+func newTx(ex sqlx.Ext, opts *sql.TxOptions) (*sqlx.Tx, sqlx.Ext, error) {
+	ctx := contextOf(ex)
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, executor{ExtContext: tx, ctx: ctx}, nil
+}
+
+// savepoint returns the name of the savepoint of a nesting depth, each
+// depth having its own name so that an inner savepoint never releases or
+// rolls back an outer one
+func savepoint(depth int) string {
+	return "sqld_sp_" + strconv.Itoa(depth)
+}
+
+// rollbackTo rolls back to a savepoint after a failure, a failing
+// rollback is reported along with the failure. The rollback runs even
+// when the failure is the end of the request context.
+func rollbackTo(ctx context.Context, tx *sqlx.Tx, name string, err error) error {
+	if _, rbErr := tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+		return InternalError(fmt.Errorf("%v, rolling back to savepoint %s failed: %w", err, name, rbErr))
+	}
+	return err
+}
+
+// runInTx runs fn in a transaction that is committed when fn succeeds
+// and rolled back otherwise. When the executor already runs in a
+// transaction, fn runs inside a savepoint of it instead.
+func runInTx(ex sqlx.Ext, fn func(tx sqlx.Ext) error) error {
+	if tx, ok := txOf(ex); ok {
+		nested := ex.(executor)
+		nested.depth++
+		name := savepoint(nested.depth)
+		if _, err := tx.ExecContext(nested.ctx, "SAVEPOINT "+name); err != nil {
+			return err
+		}
+		if err := fn(nested); err != nil {
+			return rollbackTo(nested.ctx, tx, name, err)
+		}
+		_, err := tx.ExecContext(nested.ctx, "RELEASE SAVEPOINT "+name)
+		return err
+	}
+
+	tx, txEx, err := newTx(ex, nil)
+	if err != nil {
+		return InternalError(err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(txEx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// filterOperators lists the operators accepted in a filter value,
+// e.g. ?age=gt.30 or ?deleted_at=is.null
+var filterOperators = map[string]bool{
+	"eq":      true,
+	"neq":     true,
+	"gt":      true,
+	"gte":     true,
+	"lt":      true,
+	"lte":     true,
+	"like":    true,
+	"ilike":   true,
+	"is":      true,
+	"in":      true,
+	"between": true,
+}
+
+// groupPrefixes maps the query parameter keys that start a filter group
+// onto whether the group is negated and whether it is OR-ed
+var groupPrefixes = map[string]struct{ negate, or bool }{
+	"or":      {false, true},
+	"and":     {false, false},
+	"not.or":  {true, true},
+	"not.and": {true, false},
+}
+
+// notExpr negates a squirrel expression
+type notExpr struct {
+	squirrel.Sqlizer
+}
+
+// ToSql wraps the inner expression in NOT (...)
+func (n notExpr) ToSql() (string, []interface{}, error) {
+	sql, args, err := n.Sqlizer.ToSql()
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("NOT (%s)", sql), args, nil
+}
+
+// reservedParams are the __param__ options read outside the query
+// builders, e.g. by isDryRun, requestTimeout or parseCsvOptions. They
+// never build a filter.
+var reservedParams = map[string]bool{
+	"__select__":      true,
+	"__upsert__":      true,
+	"__all__":         true,
+	"__on_conflict__": true,
+	"__resolution__":  true,
+	"__on_error__":    true,
+	"__transaction__": true,
+	"__dry_run__":     true,
+	"__timeout__":     true,
+	"__delimiter__":   true,
+	"__header__":      true,
+	"__null__":        true,
+	"__bom__":         true,
+	"__crlf__":        true,
+}
+
+// parseParam builds the conditions for a query parameter that is not a
+// __param__ handled by the builder, either an or/and filter group or a
+// column filter; reserved params build no condition. It is shared by the
+// select, update and delete builders so that reads and writes target
+// the same rows.
+func parseParam(table *TableInfo, key string, values []string) ([]squirrel.Sqlizer, error) {
+	if reservedParams[key] {
+		return nil, nil
+	}
+	group, ok := groupPrefixes[key]
+	if !ok {
+		return parseFilters(table, key, values)
+	}
+
+	var conditions []squirrel.Sqlizer
+	for _, value := range values {
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return nil, fmt.Errorf("invalid %s filter: expected %s=(...)", key, key)
+		}
+		cond, err := parseGroup(table, value[1:len(value)-1], group.or, group.negate)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+// parseGroup parses the comma separated items of a filter group such as
+// status.eq.open,or(priority.gt.3,owner.is.null) and joins them with
+// OR or AND. Items are either column.operator.value filters or nested
+// groups.
+func parseGroup(table *TableInfo, list string, or bool, negate bool) (squirrel.Sqlizer, error) {
+	items, err := splitList(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errors.New("empty filter group")
+	}
+
+	conditions := make([]squirrel.Sqlizer, 0, len(items))
+	for _, item := range items {
+		cond, err := parseGroupItem(table, item)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cond)
+	}
+
+	var group squirrel.Sqlizer = squirrel.And(conditions)
+	if or {
+		group = squirrel.Or(conditions)
+	}
+	if negate {
+		group = notExpr{group}
+	}
+	return group, nil
+}
+
+// parseGroupItem parses a single item of a filter group
+func parseGroupItem(table *TableInfo, item string) (squirrel.Sqlizer, error) {
+	if open := strings.Index(item, "("); open > 0 && strings.HasSuffix(item, ")") {
+		if group, ok := groupPrefixes[item[:open]]; ok {
+			return parseGroup(table, item[open+1:len(item)-1], group.or, group.negate)
+		}
+	}
+
+	name, filter, found := strings.Cut(item, ".")
+	if !found || name == "" {
+		return nil, fmt.Errorf("invalid filter %q: expected column.operator.value", item)
+	}
+	column, err := table.QuoteColumn(name)
+	if err != nil {
+		return nil, err
+	}
+	cond, ok, err := parseFilter(column, filter)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid filter %q: missing operator", item)
+	}
+	return cond, nil
+}
+
+// parseFilters builds the conditions for a single query parameter.
+// Values without an operator keep the original behavior and are
+// collected into a single equality (IN) condition.
+func parseFilters(table *TableInfo, name string, values []string) ([]squirrel.Sqlizer, error) {
+	column, err := table.QuoteColumn(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var conditions []squirrel.Sqlizer
+	var plain []string
+
+	for _, value := range values {
+		cond, ok, err := parseFilter(column, value)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			plain = append(plain, value)
+			continue
+		}
+		conditions = append(conditions, cond)
+	}
+
+	if len(plain) > 0 {
+		conditions = append(conditions, squirrel.Eq{column: plain})
+	}
+	return conditions, nil
+}
+
+// parseFilter turns a filter value such as "gt.30" or "not.in.(1,2)"
+// into a squirrel expression on the given, already quoted, column. The
+// boolean result is false when the value has no operator and is a plain
+// equality value.
+func parseFilter(column, value string) (squirrel.Sqlizer, bool, error) {
+	negate := false
+	rest := value
+	if strings.HasPrefix(rest, "not.") {
+		negate = true
+		rest = strings.TrimPrefix(rest, "not.")
+	}
+
+	op, operand, found := strings.Cut(rest, ".")
+	if !found || !filterOperators[op] {
+		return nil, false, nil
+	}
+
+	cond, err := buildCondition(column, op, operand, negate)
+	if err != nil {
+		return nil, false, err
+	}
+	return cond, true, nil
+}
+
+// buildCondition maps an operator and its operand onto a squirrel
+// expression, negating it when requested.
+func buildCondition(column, op, operand string, negate bool) (squirrel.Sqlizer, error) {
+	switch op {
+	case "eq":
+		if negate {
+			return squirrel.NotEq{column: operand}, nil
+		}
+		return squirrel.Eq{column: operand}, nil
+	case "neq":
+		if negate {
+			return squirrel.Eq{column: operand}, nil
+		}
+		return squirrel.NotEq{column: operand}, nil
+	case "gt":
+		if negate {
+			return squirrel.LtOrEq{column: operand}, nil
+		}
+		return squirrel.Gt{column: operand}, nil
+	case "gte":
+		if negate {
+			return squirrel.Lt{column: operand}, nil
+		}
+		return squirrel.GtOrEq{column: operand}, nil
+	case "lt":
+		if negate {
+			return squirrel.GtOrEq{column: operand}, nil
+		}
+		return squirrel.Lt{column: operand}, nil
+	case "lte":
+		if negate {
+			return squirrel.Gt{column: operand}, nil
+		}
+		return squirrel.LtOrEq{column: operand}, nil
+	case "like":
+		pattern := likePattern(operand)
+		if negate {
+			return squirrel.NotLike{column: pattern}, nil
+		}
+		return squirrel.Like{column: pattern}, nil
+	case "ilike":
+		pattern := likePattern(operand)
+		if config.Dbtype == "postgres" {
+			if negate {
+				return squirrel.NotILike{column: pattern}, nil
+			}
+			return squirrel.ILike{column: pattern}, nil
+		}
+		if negate {
+			return squirrel.Expr(fmt.Sprintf("LOWER(%s) NOT LIKE LOWER(?)", column), pattern), nil
+		}
+		return squirrel.Expr(fmt.Sprintf("LOWER(%s) LIKE LOWER(?)", column), pattern), nil
+	case "is":
+		return buildIsCondition(column, operand, negate)
+	case "in":
+		if !strings.HasPrefix(operand, "(") || !strings.HasSuffix(operand, ")") {
+			return nil, fmt.Errorf("invalid in filter on %s: expected in.(a,b,...)", column)
+		}
+		items, err := splitList(operand[1 : len(operand)-1])
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			return squirrel.NotEq{column: items}, nil
+		}
+		return squirrel.Eq{column: items}, nil
+	case "between":
+		// Parentheses are optional, but needed inside filter groups
+		if strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")") {
+			operand = operand[1 : len(operand)-1]
+		}
+		items, err := splitList(operand)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) != 2 {
+			return nil, fmt.Errorf("invalid between filter on %s: expected between.low,high", column)
+		}
+		if negate {
+			return squirrel.Expr(fmt.Sprintf("%s NOT BETWEEN ? AND ?", column), items[0], items[1]), nil
+		}
+		return squirrel.Expr(fmt.Sprintf("%s BETWEEN ? AND ?", column), items[0], items[1]), nil
+	}
+	return nil, fmt.Errorf("unknown filter operator %s", op)
+}
+
+// buildIsCondition handles the is.null, is.true and is.false filters
+func buildIsCondition(column, operand string, negate bool) (squirrel.Sqlizer, error) {
+	switch strings.ToLower(operand) {
+	case "null":
+		if negate {
+			return squirrel.NotEq{column: nil}, nil
+		}
+		return squirrel.Eq{column: nil}, nil
+	case "true", "false":
+		keyword := "IS"
+		if negate {
+			keyword = "IS NOT"
+		}
+		return squirrel.Expr(fmt.Sprintf("%s %s %s", column, keyword, strings.ToUpper(operand))), nil
+	}
+	return nil, fmt.Errorf("invalid is filter on %s: expected null, true or false", column)
+}
+
+// likePattern converts the url friendly * wildcard into the sql % wildcard
+func likePattern(operand string) string {
+	return strings.ReplaceAll(operand, "*", "%")
+}
+
+// splitList splits a comma separated list at the top level, ignoring
+// commas inside parentheses or double quotes. Top level double quoted
+// items are unquoted and a backslash escapes the next character inside
+// quotes; nested lists are kept verbatim for a later splitList call.
+func splitList(s string) ([]string, error) {
+	var items []string
+	var current strings.Builder
+	depth := 0
+	inQuotes := false
+	quoted := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuotes && c == '\\' && i+1 < len(s):
+			if depth > 0 {
+				current.WriteByte(c)
+			}
+			i++
+			current.WriteByte(s[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			if depth > 0 {
+				current.WriteByte(c)
+			} else {
+				quoted = true
+			}
+		case inQuotes:
+			current.WriteByte(c)
+		case c == '(':
+			depth++
+			current.WriteByte(c)
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("unbalanced parentheses in list")
+			}
+			current.WriteByte(c)
+		case c == ',' && depth == 0:
+			items = append(items, current.String())
+			current.Reset()
+			quoted = false
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	if inQuotes {
+		return nil, errors.New("unterminated quote in list")
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses in list")
+	}
+	if current.Len() > 0 || quoted || len(items) > 0 {
+		items = append(items, current.String())
+	}
+	return items, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list  string
+		items []string
+		err   bool
+	}{
+		{"", nil, false},
+		{"a", []string{"a"}, false},
+		{"a,b,c", []string{"a", "b", "c"}, false},
+		{"a,,b", []string{"a", "", "b"}, false},
+		{`""`, []string{""}, false},
+		{`"a,b",c`, []string{"a,b", "c"}, false},
+		{`"say \"hi\"",x`, []string{`say "hi"`, "x"}, false},
+		{`"a\\b"`, []string{`a\b`}, false},
+		{"age.gt.1,and(name.eq.a,age.lt.9)", []string{"age.gt.1", "and(name.eq.a,age.lt.9)"}, false},
+		{`or(name.eq."a,b",id.eq.1),x`, []string{`or(name.eq."a,b",id.eq.1)`, "x"}, false},
+		{`and(name.eq."a\"b")`, []string{`and(name.eq."a\"b")`}, false},
+		{"a,(b", nil, true},
+		{"a),b", nil, true},
+		{`"a,b`, nil, true},
+	}
+
+	for _, test := range tests {
+		items, err := splitList(test.list)
+		if (err != nil) != test.err || !reflect.DeepEqual(items, test.items) {
+			t.Errorf("splitList(%q) = %q, %v, want %q, error %v", test.list, items, err, test.items, test.err)
+		}
+	}
+}
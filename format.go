@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// responseTypes are the media types a response can have, in order of
+// preference when the Accept header allows several of them. The first
+// one is the default.
+var responseTypes = []string{"application/json", "text/csv", "text/tsv", "application/x-ndjson"}
+
+// mediaTypeAliases maps alternative names onto the response types
+var mediaTypeAliases = map[string]string{
+	"text/tab-separated-values": "text/tsv",
+	"application/jsonl":         "application/x-ndjson",
+}
+
+// mediaRange is a media range of an Accept header along with its
+// quality
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// negotiateType returns the response type best matching the Accept
+// headers of the request. Each type takes the quality of the most
+// specific range matching it, e.g. text/csv before text/* before */*.
+// Among types of equal quality, the one matched by the more specific
+// range wins, then the one the client lists first. The default type is
+// returned when none is acceptable.
+func negotiateType(r *http.Request) string {
+	var ranges []mediaRange
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+			if alias, ok := mediaTypeAliases[mediaType]; ok {
+				mediaType = alias
+			}
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+
+	best, bestQ, bestSpecificity, bestIndex := responseTypes[0], 0.0, 0, 0
+	for _, responseType := range responseTypes {
+		q, specificity, index := 0.0, 0, 0
+		for i, rg := range ranges {
+			if s := rangeSpecificity(rg.mediaType, responseType); s > specificity {
+				q, specificity, index = rg.q, s, i
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && (specificity > bestSpecificity || (specificity == bestSpecificity && index < bestIndex))) {
+			best, bestQ, bestSpecificity, bestIndex = responseType, q, specificity, index
+		}
+	}
+	return best
+}
+
+// rangeSpecificity reports how specifically a media range matches a
+// media type: 3 for the type itself, 2 for type/*, 1 for */* and 0 when
+// the range does not match
+func rangeSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	}
+	return 0
+}
+
+// csvOptions are the options of a csv or tsv response
+type csvOptions struct {
+	tsv    bool
+	comma  rune   // field delimiter, __delimiter__
+	header bool   // header line with the column names, __header__
+	null   string // text of NULL values, __null__
+	bom    bool   // leading byte order mark for Excel, __bom__
+	crlf   bool   // CRLF line terminator, __crlf__
+}
+
+// parseCsvOptions reads the options of a csv or tsv response from the
+// query string. Fields are separated by a comma, or a tab for tsv, and
+// the lines end with LF; NULL values are empty.
+func parseCsvOptions(r *http.Request) (csvOptions, *SqldError) {
+	args := r.URL.Query()
+	opts := csvOptions{tsv: negotiateType(r) == "text/tsv", comma: ',', header: true}
+	if opts.tsv {
+		opts.comma = '\t'
+	}
+
+	if delimiter, ok := args["__delimiter__"]; ok {
+		value := delimiter[0]
+		if value == "tab" || value == `\t` {
+			value = "\t"
+		}
+		comma, size := utf8.DecodeRuneInString(value)
+		if size == 0 || size != len(value) || comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+			return opts, BadRequest(fmt.Errorf("invalid __delimiter__ %s: expected a single character", delimiter[0]))
+		}
+		opts.comma = comma
+	}
+	if null, ok := args["__null__"]; ok {
+		opts.null = null[0]
+	}
+
+	for name, option := range map[string]*bool{"__header__": &opts.header, "__bom__": &opts.bom, "__crlf__": &opts.crlf} {
+		if value, ok := args[name]; ok {
+			b, err := strconv.ParseBool(value[0])
+			if err != nil {
+				return opts, BadRequest(fmt.Errorf("invalid %s %s: expected true or false", name, value[0]))
+			}
+			*option = b
+		}
+	}
+	return opts, nil
+}
+
+// contentType returns the content type of the response
+func (opts csvOptions) contentType() string {
+	if opts.tsv {
+		return "text/tsv; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// newWriter returns a csv writer following the options, after writing
+// the byte order mark when asked for
+func (opts csvOptions) newWriter(w io.Writer) (*csv.Writer, error) {
+	if opts.bom {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return nil, err
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.comma
+	cw.UseCRLF = opts.crlf
+	return cw, nil
+}
+
+// record formats values as the fields of a csv line, nested json and
+// arrays as their json text
+func (opts csvOptions) record(values []interface{}) []string {
+	fields := make([]string, len(values))
+	for i, val := range values {
+		switch v := val.(type) {
+		case nil:
+			fields[i] = opts.null
+		case string:
+			fields[i] = v
+		case json.RawMessage:
+			fields[i] = string(v)
+		case []interface{}:
+			text, _ := json.Marshal(v)
+			fields[i] = string(text)
+		default:
+			fields[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return fields
+}
+
+// writeRows writes the header, when asked for, and the rows of a csv
+// response
+func (opts csvOptions) writeRows(w io.Writer, columns []string, rows [][]interface{}) error {
+	cw, err := opts.newWriter(w)
+	if err != nil {
+		return err
+	}
+	if opts.header {
+		cw.Write(columns)
+	}
+	for _, values := range rows {
+		cw.Write(opts.record(values))
+	}
+	cw.Flush()
+	return cw.Error()
+}
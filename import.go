@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// importBatchSize is the maximum number of rows inserted per statement
+// when importing a file
+const importBatchSize = 1000
+
+// ImportError reports a line of an imported file that was not inserted
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportResult reports the outcome of a CSV or TSV import
+type ImportResult struct {
+	RowsAffected int64         `json:"rows_affected"`
+	Errors       []ImportError `json:"errors,omitempty"`
+}
+
+// importRow is a parsed record along with its line in the file
+type importRow struct {
+	line   int
+	values []interface{}
+}
+
+// importer inserts the records of an imported file in batches
+type importer struct {
+	qualifiedTable string
+	columns        []string
+	skip           bool
+	tx             *sqlx.Tx
+	ctx            context.Context
+	owned          bool // whether the importer began the transaction
+	depth          int  // savepoint depth of the import in the transaction
+	result         ImportResult
+}
+
+// importCsv handles a POST with a CSV or TSV body. The header row maps
+// the fields onto columns and the records are streamed from the body
+// and inserted in batches. With __on_error__=abort, the default, the
+// whole file is imported in one transaction that is rolled back on the
+// first error. With __on_error__=skip every batch is committed on its
+// own and failing lines are skipped and reported. Inside an interactive
+// transaction nothing is committed, an aborted import is rolled back to
+// the savepoint taken before it.
+func importCsv(r *http.Request, tsv bool) (response interface{}, sqldErr *SqldError) {
+	defer r.Body.Close()
+	table, args, _ := parseRequest(r)
+
+	info, err := lookupTable(r.Context(), table)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	if isDryRun(r) {
+		return nil, BadRequest(errors.New("dry run is not supported for imports"))
+	}
+
+	skip := false
+	if onError, ok := args["__on_error__"]; ok {
+		switch onError[0] {
+		case "abort":
+		case "skip":
+			skip = true
+		default:
+			return nil, BadRequest(fmt.Errorf("invalid __on_error__ %s: expected abort or skip", onError[0]))
+		}
+	}
+
+	// Empty fields are imported as NULL unless __null__ says otherwise
+	nullValue := ""
+	if null, ok := args["__null__"]; ok {
+		nullValue = null[0]
+	}
+
+	// The delimiter of an exported file, __delimiter__, reads it back
+	reader := csv.NewReader(r.Body)
+	if tsv {
+		reader.Comma = '\t'
+	}
+	if _, ok := args["__delimiter__"]; ok {
+		opts, sqldErr := parseCsvOptions(r)
+		if sqldErr != nil {
+			return nil, sqldErr
+		}
+		reader.Comma = opts.comma
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, BadRequest(errors.New("empty request"))
+	}
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	// Excel prefixes UTF-8 files with a byte order mark
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	im := &importer{qualifiedTable: config.GetTableName(table), skip: skip}
+	for _, name := range header {
+		column, err := info.QuoteColumn(strings.TrimSpace(name))
+		if err != nil {
+			return nil, toSqldError(err)
+		}
+		im.columns = append(im.columns, column)
+	}
+
+	batchSize := min(importBatchSize, maxPlaceholders()/len(im.columns))
+	im.ctx = r.Context()
+	ex := getExecutor(r)
+	if tx, ok := txOf(ex); ok {
+		im.tx = tx
+		im.depth = ex.(executor).depth + 1
+		if _, err := im.tx.ExecContext(im.ctx, "SAVEPOINT "+savepoint(im.depth)); err != nil {
+			return nil, InternalError(err)
+		}
+	} else {
+		im.owned = true
+		im.tx, err = db.BeginTxx(im.ctx, nil)
+		if err != nil {
+			return nil, InternalError(err)
+		}
+	}
+	completed := false
+	defer func() {
+		if im.owned {
+			im.tx.Rollback()
+		} else if !completed && sqldErr != nil {
+			response, sqldErr = nil, toSqldError(rollbackTo(im.ctx, im.tx, savepoint(im.depth), sqldErr))
+		}
+	}()
+
+	var batch []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A parse error may come without any field, its position is
+			// taken from the error
+			line := 0
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+				if line == 0 {
+					line = parseErr.Line
+				}
+			}
+			if !skip {
+				// A failing row of the pending batch comes before the
+				// parse error
+				if err := im.flush(batch); err != nil {
+					return nil, err
+				}
+				return nil, BadRequest(fmt.Errorf("line %d: %w", line, err))
+			}
+			im.result.Errors = append(im.result.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		values := make([]interface{}, len(record))
+		for i, field := range record {
+			if field == nullValue {
+				values[i] = nil
+			} else {
+				values[i] = field
+			}
+		}
+		batch = append(batch, importRow{line: line, values: values})
+
+		if len(batch) >= batchSize {
+			if err := im.flush(batch); err != nil {
+				return nil, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if err := im.flush(batch); err != nil {
+		return nil, err
+	}
+	if im.owned {
+		err = im.tx.Commit()
+	} else {
+		_, err = im.tx.ExecContext(im.ctx, "RELEASE SAVEPOINT "+savepoint(im.depth))
+	}
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	completed = true
+
+	// Parse errors are reported before the failing rows of their batch
+	sort.SliceStable(im.result.Errors, func(i, j int) bool {
+		return im.result.Errors[i].Line < im.result.Errors[j].Line
+	})
+	return Created{Data: im.result}, nil
+}
+
+// flush inserts a batch of rows. When the batch fails, its rows are
+// inserted one at a time to find the failing lines, which abort the
+// import or are skipped and reported. In skip mode the batch is then
+// committed and a new transaction is started, unless the import runs in
+// an interactive transaction.
+func (im *importer) flush(batch []importRow) *SqldError {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if rowsAffected, err := im.insert(batch); err == nil {
+		im.result.RowsAffected += rowsAffected
+	} else {
+		for _, row := range batch {
+			rowsAffected, err := im.insert([]importRow{row})
+			if err != nil {
+				if !im.skip {
+					return BadRequest(fmt.Errorf("line %d: %w", row.line, err))
+				}
+				im.result.Errors = append(im.result.Errors, ImportError{Line: row.line, Error: err.Error()})
+				continue
+			}
+			im.result.RowsAffected += rowsAffected
+		}
+	}
+
+	if !im.skip || !im.owned {
+		return nil
+	}
+	if err := im.tx.Commit(); err != nil {
+		return BadRequest(err)
+	}
+	tx, err := db.BeginTxx(im.ctx, nil)
+	if err != nil {
+		return InternalError(err)
+	}
+	im.tx = tx
+	return nil
+}
+
+// insert runs a multi-row INSERT inside a savepoint, so that a failing
+// statement does not abort the surrounding transaction
+func (im *importer) insert(rows []importRow) (int64, error) {
+	query := sq.Insert(im.qualifiedTable).Columns(im.columns...)
+	for _, row := range rows {
+		if len(row.values) != len(im.columns) {
+			return 0, fmt.Errorf("expected %d fields, got %d", len(im.columns), len(row.values))
+		}
+		query = query.Values(row.values...)
+	}
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	name := savepoint(im.depth + 1)
+	if _, err := im.tx.ExecContext(im.ctx, "SAVEPOINT "+name); err != nil {
+		return 0, err
+	}
+	res, err := im.tx.ExecContext(im.ctx, sql, args...)
+	if err != nil {
+		return 0, rollbackTo(im.ctx, im.tx, name, err)
+	}
+	if _, err := im.tx.ExecContext(im.ctx, "RELEASE SAVEPOINT "+name); err != nil {
+		return 0, err
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected, nil
+}
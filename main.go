@@ -32,6 +32,9 @@ func main() {
 		printInfo()
 		config.print()
 	}
+	if err := config.loadQueries(); err != nil {
+		log.Fatalf("Unable to load the saved queries: %s\n", err)
+	}
 
 	var err error
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseOrderBy turns the __order_by__ values into ORDER BY expressions.
+// Each comma separated item must be a column of the table optionally
+// followed by ASC or DESC and NULLS FIRST or NULLS LAST, anything else
+// is rejected.
+func parseOrderBy(table *TableInfo, values []string) ([]string, error) {
+	var orderBy []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			fields := strings.Fields(item)
+			if len(fields) == 0 {
+				continue
+			}
+
+			column, err := table.QuoteColumn(fields[0])
+			if err != nil {
+				return nil, err
+			}
+
+			direction := ""
+			nulls := ""
+			rest := fields[1:]
+			if len(rest) > 0 {
+				switch strings.ToUpper(rest[0]) {
+				case "ASC", "DESC":
+					direction = strings.ToUpper(rest[0])
+					rest = rest[1:]
+				}
+			}
+			if len(rest) == 2 && strings.ToUpper(rest[0]) == "NULLS" {
+				switch strings.ToUpper(rest[1]) {
+				case "FIRST", "LAST":
+					nulls = strings.ToUpper(rest[1])
+					rest = rest[2:]
+				}
+			}
+			if len(rest) > 0 {
+				return nil, BadRequest(fmt.Errorf("invalid order by %q: expected column [ASC|DESC] [NULLS FIRST|LAST]", strings.TrimSpace(item)))
+			}
+
+			orderBy = append(orderBy, orderByTerms(column, direction, nulls)...)
+		}
+	}
+	return orderBy, nil
+}
+
+// orderByTerms builds the ORDER BY terms for a single column. MySQL has
+// no NULLS FIRST/LAST, so it is emulated by sorting on IS NULL first.
+func orderByTerms(column, direction, nulls string) []string {
+	term := strings.TrimSpace(column + " " + direction)
+	if nulls == "" {
+		return []string{term}
+	}
+	if config.Dbtype == "mysql" {
+		nullsOrder := "ASC"
+		if nulls == "FIRST" {
+			nullsOrder = "DESC"
+		}
+		return []string{fmt.Sprintf("%s IS NULL %s", column, nullsOrder), term}
+	}
+	return []string{term + " NULLS " + nulls}
+}
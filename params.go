@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// bindParams binds the params of a raw query. An array binds the ?
+// placeholders in order, an object binds :name placeholders. The
+// placeholders are replaced by those of the database, e.g. $1 for
+// PostgreSQL. Without params the query is left as it is.
+func bindParams(query string, params json.RawMessage) (string, []interface{}, error) {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return query, nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return "", nil, err
+	}
+
+	switch p := decoded.(type) {
+	case []interface{}:
+		args := make([]interface{}, len(p))
+		for i, value := range p {
+			args[i] = paramValue(value)
+		}
+		bound, err := bindPositional(query, len(args))
+		if err != nil {
+			return "", nil, err
+		}
+		return bound, args, nil
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(p))
+		for name, value := range p {
+			values[name] = paramValue(value)
+		}
+		return bindNamed(query, values)
+	}
+	return "", nil, errors.New("params must be an array or an object")
+}
+
+// bindNamed binds the :name placeholders of a query, which are replaced
+// by the placeholders of the database, e.g. $1 for PostgreSQL
+func bindNamed(query string, values map[string]interface{}) (string, []interface{}, error) {
+	var bound strings.Builder
+	var args []interface{}
+	last := 0
+	err := scanNamed(query, func(start, end int) error {
+		name := query[start+1 : end]
+		value, ok := values[name]
+		if !ok {
+			return fmt.Errorf("missing value for parameter %s", name)
+		}
+		args = append(args, value)
+		bound.WriteString(query[last:start])
+		bound.WriteString(placeholder(len(args)))
+		last = end
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	bound.WriteString(query[last:])
+	return bound.String(), args, nil
+}
+
+// bindPositional replaces the ? placeholders of a query by those of the
+// database, skipping literals and comments. On PostgreSQL the ?| and ?&
+// operators are kept, and ?? stands for the jsonb ? operator.
+func bindPositional(query string, count int) (string, error) {
+	var bound strings.Builder
+	n, last := 0, 0
+	for i := 0; i < len(query); {
+		if end := scanLiteral(query, i); end > i {
+			i = end
+			continue
+		}
+		if query[i] != '?' {
+			i++
+			continue
+		}
+
+		bound.WriteString(query[last:i])
+		next := byte(0)
+		if i+1 < len(query) {
+			next = query[i+1]
+		}
+		switch {
+		case config.Dbtype == "postgres" && next == '?':
+			bound.WriteString("?")
+			i += 2
+		case config.Dbtype == "postgres" && (next == '|' || next == '&'):
+			bound.WriteString(query[i : i+2])
+			i += 2
+		default:
+			n++
+			bound.WriteString(placeholder(n))
+			i++
+		}
+		last = i
+	}
+	bound.WriteString(query[last:])
+
+	if n != count {
+		return "", fmt.Errorf("the query has %d placeholders but %d params are given", n, count)
+	}
+	return bound.String(), nil
+}
+
+// placeholder returns the nth placeholder of the database, e.g. $1 for
+// PostgreSQL
+func placeholder(n int) string {
+	if sqlx.BindType(db.DriverName()) == sqlx.DOLLAR {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// namedParams returns the names of the :name placeholders of a query in
+// order of appearance
+func namedParams(query string) []string {
+	var names []string
+	scanNamed(query, func(start, end int) error {
+		if name := query[start+1 : end]; !contains(names, name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+// scanNamed calls fn with the bounds of every :name placeholder of a
+// query, skipping literals, comments and :: casts
+func scanNamed(query string, fn func(start, end int) error) error {
+	for i := 0; i < len(query); {
+		if end := scanLiteral(query, i); end > i {
+			i = end
+			continue
+		}
+		if query[i] != ':' {
+			i++
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == ':' {
+			i += 2
+			continue
+		}
+		end := i + 1
+		if end >= len(query) || !isWordStart(query[end]) {
+			i++
+			continue
+		}
+		for end < len(query) && (isWordStart(query[end]) || isDigit(query[end])) {
+			end++
+		}
+		if err := fn(i, end); err != nil {
+			return err
+		}
+		i = end
+	}
+	return nil
+}
+
+// paramValue converts a decoded json value into a query argument.
+// Integral numbers keep their precision, arrays and objects are passed
+// as their json text.
+func paramValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}, map[string]interface{}:
+		text, _ := json.Marshal(v)
+		return string(text)
+	}
+	return value
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestBindPositional(t *testing.T) {
+	tests := []struct {
+		dbtype string
+		query  string
+		count  int
+		bound  string
+		err    bool
+	}{
+		{"postgres", "SELECT * FROM t WHERE a = ? AND b = ?", 2, "SELECT * FROM t WHERE a = $1 AND b = $2", false},
+		{"postgres", "SELECT '?' FROM t WHERE id = ?", 1, "SELECT '?' FROM t WHERE id = $1", false},
+		{"postgres", `SELECT "a?" FROM t WHERE id = ?`, 1, `SELECT "a?" FROM t WHERE id = $1`, false},
+		{"postgres", "SELECT 1 -- ?\nWHERE id = ?", 1, "SELECT 1 -- ?\nWHERE id = $1", false},
+		{"postgres", "SELECT /* ? */ $$?$$, ?", 1, "SELECT /* ? */ $$?$$, $1", false},
+		{"postgres", "SELECT doc ?? 'key', doc ?| ?, doc ?& ? FROM t", 2, "SELECT doc ? 'key', doc ?| $1, doc ?& $2 FROM t", false},
+		{"postgres", "SELECT ?", 2, "", true},
+		{"postgres", "SELECT ?, ?", 1, "", true},
+		{"mysql", "SELECT 'it\\'s ?', ? FROM t", 1, "SELECT 'it\\'s ?', ? FROM t", false},
+		{"sqlite3", "SELECT ?, '?'", 1, "SELECT ?, '?'", false},
+		{"sqlite3", "SELECT 1", 0, "SELECT 1", false},
+	}
+
+	defer func(dbtype string, saved *sqlx.DB) { config.Dbtype, db = dbtype, saved }(config.Dbtype, db)
+	for _, test := range tests {
+		config.Dbtype = test.dbtype
+		db = sqlx.NewDb(nil, test.dbtype)
+		bound, err := bindPositional(test.query, test.count)
+		if (err != nil) != test.err || bound != test.bound {
+			t.Errorf("%s: bindPositional(%q, %d) = %q, %v, want %q, error %v",
+				test.dbtype, test.query, test.count, bound, err, test.bound, test.err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parseProjection turns the __select__ values, e.g. id,name,total:amount,
+// into the select expressions for the table. Columns are validated
+// against the table's columns and quoted, an alias:column item selects
+// the column under the alias.
+func parseProjection(table *TableInfo, values []string) ([]string, error) {
+	var columns []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+
+			alias, column, aliased := strings.Cut(item, ":")
+			if !aliased {
+				column = alias
+			}
+			quoted, err := table.QuoteColumn(column)
+			if err != nil {
+				return nil, err
+			}
+			if !aliased {
+				columns = append(columns, quoted)
+				continue
+			}
+			if alias == "" {
+				return nil, BadRequest(fmt.Errorf("empty alias for column %s", column))
+			}
+			columns = append(columns, fmt.Sprintf("%s AS %s", quoted, config.QuoteIdent(alias)))
+		}
+	}
+
+	if len(columns) == 0 {
+		return nil, BadRequest(errors.New("empty __select__"))
+	}
+	return columns, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// queryParamTypes lists the types a saved query parameter can have
+var queryParamTypes = map[string]bool{
+	"string":   true,
+	"int":      true,
+	"float":    true,
+	"bool":     true,
+	"date":     true,
+	"datetime": true,
+}
+
+// SavedQuery is a named read query of the config file, served at
+// {base}/_query/{name}
+type SavedQuery struct {
+	Name   string       `json:"name"`
+	SQL    string       `json:"-"`
+	Params []QueryParam `json:"params"`
+}
+
+// QueryParam is a typed parameter of a saved query
+type QueryParam struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Default  *string  `json:"default,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+// loadQueries reads the saved queries of the config file. A query is
+// either given as its sql, whose parameters are required strings, or
+// as an object with the sql and the params by name, each param being a
+// type or an object with a type, a default and, for numbers, a min and
+// a max. Parameters without a default are required.
+func (c *Config) loadQueries() error {
+	c.Queries = map[string]*SavedQuery{}
+	if c.ConfigFile == "" {
+		return nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(c.ConfigFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	for name, definition := range v.GetStringMap("queries") {
+		query, err := parseSavedQuery(name, definition)
+		if err != nil {
+			return fmt.Errorf("query %s: %w", name, err)
+		}
+		c.Queries[name] = query
+	}
+	return nil
+}
+
+// parseSavedQuery parses the definition of a saved query. The config
+// keys are case insensitive, so are the names of the parameters.
+func parseSavedQuery(name string, definition interface{}) (*SavedQuery, error) {
+	query := &SavedQuery{Name: name}
+	specs := map[string]interface{}{}
+	switch d := definition.(type) {
+	case string:
+		query.SQL = d
+	case map[string]interface{}:
+		query.SQL, _ = d["sql"].(string)
+		if params, ok := d["params"]; ok {
+			if specs, ok = params.(map[string]interface{}); !ok {
+				return nil, errors.New("expected the params by name")
+			}
+		}
+	default:
+		return nil, errors.New("expected the sql or an object with sql and params")
+	}
+	query.SQL = strings.TrimSpace(query.SQL)
+	if query.SQL == "" {
+		return nil, errors.New("empty sql")
+	}
+	if stmt := classifyStatement(query.SQL); stmt.Kind != readStatement {
+		return nil, errors.New("only reads can be saved queries")
+	}
+
+	names := namedParams(query.SQL)
+	for key := range specs {
+		found := false
+		for _, paramName := range names {
+			found = found || strings.EqualFold(paramName, key)
+		}
+		if !found {
+			return nil, fmt.Errorf("param %s is not used in the sql", key)
+		}
+	}
+
+	for _, paramName := range names {
+		param, err := parseQueryParam(paramName, specs[strings.ToLower(paramName)])
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %w", paramName, err)
+		}
+		query.Params = append(query.Params, param)
+	}
+	return query, nil
+}
+
+// parseQueryParam parses the spec of a saved query parameter
+func parseQueryParam(name string, spec interface{}) (QueryParam, error) {
+	param := QueryParam{Name: name, Type: "string"}
+	switch s := spec.(type) {
+	case nil:
+	case string:
+		param.Type = s
+	case map[string]interface{}:
+		if t, ok := s["type"]; ok {
+			param.Type = fmt.Sprint(t)
+		}
+		if d, ok := s["default"]; ok && d != nil {
+			dflt := fmt.Sprint(d)
+			param.Default = &dflt
+		}
+		for key, bound := range map[string]**float64{"min": &param.Min, "max": &param.Max} {
+			if value, ok := s[key]; ok {
+				number, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+				if err != nil {
+					return param, fmt.Errorf("invalid %s %v", key, value)
+				}
+				*bound = &number
+			}
+		}
+	default:
+		return param, errors.New("expected a type or an object with type, default, min and max")
+	}
+
+	if !queryParamTypes[param.Type] {
+		return param, fmt.Errorf("unknown type %s", param.Type)
+	}
+	if param.Default != nil {
+		if _, err := param.Convert(*param.Default); err != nil {
+			return param, fmt.Errorf("invalid default: %w", err)
+		}
+	}
+	param.Required = param.Default == nil
+	return param, nil
+}
+
+// Convert validates a request value against the type and the bounds of
+// the parameter and converts it into a query argument. Dates are checked
+// and passed on as text.
+func (p QueryParam) Convert(value string) (interface{}, error) {
+	var number float64
+	var converted interface{}
+	switch p.Type {
+	case "string":
+		return value, nil
+	case "int":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an int", value)
+		}
+		number, converted = float64(i), i
+	case "float":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a float", value)
+		}
+		number, converted = f, f
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a bool", value)
+		}
+		return b, nil
+	case "date":
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return nil, fmt.Errorf("%s is not a date, expected YYYY-MM-DD", value)
+		}
+		return value, nil
+	case "datetime":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("%s is not a datetime, expected RFC 3339", value)
+		}
+		return value, nil
+	}
+
+	if p.Min != nil && number < *p.Min {
+		return nil, fmt.Errorf("%s is less than %v", value, *p.Min)
+	}
+	if p.Max != nil && number > *p.Max {
+		return nil, fmt.Errorf("%s is more than %v", value, *p.Max)
+	}
+	return converted, nil
+}
+
+// savedQuery handles GET {base}/_query/{name}, running the saved query
+// with the parameters of the query string. GET {base}/_query lists the
+// saved queries and their parameters.
+func savedQuery(r *http.Request) (interface{}, *SqldError) {
+	if r.Method != "GET" {
+		return nil, &SqldError{http.StatusMethodNotAllowed, errors.New("MethodNotAllowed")}
+	}
+
+	_, _, name := parseRequest(r)
+	args := r.URL.Query()
+	if name == "" {
+		queries := make([]*SavedQuery, 0, len(config.Queries))
+		for _, query := range config.Queries {
+			queries = append(queries, query)
+		}
+		sort.Slice(queries, func(i, j int) bool { return queries[i].Name < queries[j].Name })
+		return queries, nil
+	}
+
+	query, ok := config.Queries[strings.ToLower(name)]
+	if !ok {
+		return nil, NotFound(fmt.Errorf("query %s not found", name))
+	}
+
+	// Reserved __param__ keys are left to the response writers
+	for key := range args {
+		if strings.HasPrefix(key, "__") && strings.HasSuffix(key, "__") {
+			continue
+		}
+		known := false
+		for _, param := range query.Params {
+			known = known || param.Name == key
+		}
+		if !known {
+			return nil, BadRequest(fmt.Errorf("unknown parameter %s", key))
+		}
+	}
+
+	values := map[string]interface{}{}
+	for _, param := range query.Params {
+		value := args.Get(param.Name)
+		if !args.Has(param.Name) {
+			if param.Default == nil {
+				return nil, BadRequest(fmt.Errorf("missing parameter %s", param.Name))
+			}
+			value = *param.Default
+		}
+		converted, err := param.Convert(value)
+		if err != nil {
+			return nil, BadRequest(fmt.Errorf("invalid parameter %s: %w", param.Name, err))
+		}
+		values[param.Name] = converted
+	}
+
+	sql, bound, err := bindNamed(query.SQL, values)
+	if err != nil {
+		return nil, InternalError(err)
+	}
+	if config.Debug {
+		log.Printf("[DEBUG] Saved query %s: %s with args: %v", query.Name, sql, bound)
+	}
+
+	tableData, err := readRows(getExecutor(r), sql, bound)
+	if err != nil {
+		return nil, BadRequest(err)
+	}
+	return tableData, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// TableInfo describes a table or view as found in the database catalog
+type TableInfo struct {
+	Name       string
+	Columns    []string
+	PrimaryKey []string
+	Defaults   map[string]string // default expression of the columns that have one
+}
+
+// catalogColumn is a column as read from the catalog
+type catalogColumn struct {
+	Name    string         `db:"name"`
+	Default sql.NullString `db:"dflt"`
+}
+
+// HasColumn reports whether the table has a column with the given name
+func (t *TableInfo) HasColumn(name string) bool {
+	return contains(t.Columns, name)
+}
+
+// QuoteColumn validates a column name coming from the request against
+// the table and returns it quoted for the database type
+func (t *TableInfo) QuoteColumn(name string) (string, error) {
+	if !t.HasColumn(name) {
+		return "", BadRequest(fmt.Errorf("unknown column %s in table %s", name, t.Name))
+	}
+	return config.QuoteIdent(name), nil
+}
+
+// KeyCondition builds the WHERE condition selecting the row identified
+// by the id path segment. Composite keys are given as comma separated
+// values in primary key order, e.g. /order_items/42,7
+func (t *TableInfo) KeyCondition(id string) (squirrel.Sqlizer, error) {
+	if len(t.PrimaryKey) == 0 {
+		return nil, BadRequest(fmt.Errorf("table %s has no primary key", t.Name))
+	}
+
+	values := strings.Split(id, ",")
+	if len(values) != len(t.PrimaryKey) {
+		return nil, BadRequest(fmt.Errorf("table %s expects %d key values (%s), got %d",
+			t.Name, len(t.PrimaryKey), strings.Join(t.PrimaryKey, ","), len(values)))
+	}
+
+	cond := squirrel.Eq{}
+	for i, column := range t.PrimaryKey {
+		cond[config.QuoteIdent(column)] = values[i]
+	}
+	return cond, nil
+}
+
+// schemaTTL is the time the catalog information of a table is cached,
+// after which it is read again so that outside migrations are seen
+const schemaTTL = time.Minute
+
+// schemaEntry is the catalog information of a table, ready is closed
+// once it has been read. cancelled reports a read stopped by the end of
+// the request that made it.
+type schemaEntry struct {
+	ready     chan struct{}
+	info      *TableInfo
+	err       error
+	cancelled bool
+	loaded    time.Time
+}
+
+// expired reports whether the entry has been read and is older than
+// schemaTTL
+func (e *schemaEntry) expired() bool {
+	select {
+	case <-e.ready:
+		return time.Since(e.loaded) > schemaTTL
+	default:
+		return false
+	}
+}
+
+// schemaCache caches the catalog lookups per table name. The lock only
+// guards the map, the catalog is read outside of it.
+var schemaCache = struct {
+	sync.Mutex
+	tables map[string]*schemaEntry
+}{tables: map[string]*schemaEntry{}}
+
+// lookupTable returns the catalog information for a table, reading it
+// from the database the first time the table is requested and once it
+// has expired. Concurrent requests for a table wait for a single read of
+// the catalog.
+func lookupTable(ctx context.Context, table string) (*TableInfo, error) {
+	for {
+		schemaCache.Lock()
+		entry, ok := schemaCache.tables[table]
+		if !ok || entry.expired() {
+			entry = &schemaEntry{ready: make(chan struct{})}
+			schemaCache.tables[table] = entry
+			schemaCache.Unlock()
+			return loadEntry(ctx, table, entry)
+		}
+		schemaCache.Unlock()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The read of another request may have been cancelled, the table
+		// is then read again
+		if entry.cancelled {
+			continue
+		}
+		return entry.info, entry.err
+	}
+}
+
+// loadEntry reads the catalog information of an entry. Failed reads are
+// not cached.
+func loadEntry(ctx context.Context, table string, entry *schemaEntry) (*TableInfo, error) {
+	entry.info, entry.err = loadTable(ctx, table)
+	entry.cancelled = entry.err != nil && ctx.Err() != nil
+	entry.loaded = time.Now()
+	close(entry.ready)
+
+	if entry.err != nil {
+		schemaCache.Lock()
+		if schemaCache.tables[table] == entry {
+			delete(schemaCache.tables, table)
+		}
+		schemaCache.Unlock()
+	}
+	return entry.info, entry.err
+}
+
+// loadTable reads the catalog information of a table
+func loadTable(ctx context.Context, table string) (*TableInfo, error) {
+	catalog, err := loadColumns(ctx, table)
+	if err != nil {
+		return nil, InternalError(err)
+	}
+	if len(catalog) == 0 {
+		return nil, NotFound(fmt.Errorf("table %s not found", table))
+	}
+
+	columns := make([]string, len(catalog))
+	defaults := map[string]string{}
+	for i, column := range catalog {
+		columns[i] = column.Name
+		if column.Default.Valid {
+			defaults[column.Name] = column.Default.String
+		}
+	}
+
+	primaryKey, err := resolvePrimaryKey(ctx, table, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &TableInfo{Name: table, Columns: columns, PrimaryKey: primaryKey, Defaults: defaults}, nil
+}
+
+// invalidateSchema drops the cached catalog information, it is called
+// after statements that may have changed the schema
+func invalidateSchema() {
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+	schemaCache.tables = map[string]*schemaEntry{}
+}
+
+// loadColumns reads the columns of a table in ordinal order
+func loadColumns(ctx context.Context, table string) ([]catalogColumn, error) {
+	var columns []catalogColumn
+	var err error
+	switch config.Dbtype {
+	case "postgres":
+		schema := config.Schema
+		if schema == "" {
+			schema = "public"
+		}
+		err = db.SelectContext(ctx, &columns, `SELECT column_name AS name, column_default AS dflt
+			FROM information_schema.columns
+			WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`, schema, table)
+	case "mysql":
+		err = db.SelectContext(ctx, &columns, `SELECT column_name AS name, column_default AS dflt
+			FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = ? ORDER BY ordinal_position`, table)
+	case "sqlite3":
+		err = db.SelectContext(ctx, &columns, `SELECT name, dflt_value AS dflt FROM pragma_table_info(?) ORDER BY cid`, table)
+	default:
+		err = fmt.Errorf("unsupported database type %s", config.Dbtype)
+	}
+	return columns, err
+}
+
+// resolvePrimaryKey returns the primary key columns of a table. The
+// configured override wins over the catalog, tables without a declared
+// primary key, such as views, fall back to an id column when present.
+func resolvePrimaryKey(ctx context.Context, table string, columns []string) ([]string, error) {
+	if override, ok := config.PrimaryKeys[table]; ok {
+		for _, column := range override {
+			if !contains(columns, column) {
+				return nil, InternalError(fmt.Errorf("primary key override %s is not a column of table %s", column, table))
+			}
+		}
+		return override, nil
+	}
+
+	primaryKey, err := loadPrimaryKey(ctx, table)
+	if err != nil {
+		return nil, InternalError(err)
+	}
+	if len(primaryKey) == 0 && contains(columns, "id") {
+		primaryKey = []string{"id"}
+	}
+	return primaryKey, nil
+}
+
+// loadPrimaryKey reads the primary key columns of a table in key order
+func loadPrimaryKey(ctx context.Context, table string) ([]string, error) {
+	var columns []string
+	var err error
+	switch config.Dbtype {
+	case "postgres":
+		schema := config.Schema
+		if schema == "" {
+			schema = "public"
+		}
+		err = db.SelectContext(ctx, &columns, `SELECT kcu.column_name FROM information_schema.table_constraints tc
+			JOIN information_schema.key_column_usage kcu
+			ON kcu.constraint_schema = tc.constraint_schema AND kcu.constraint_name = tc.constraint_name
+			AND kcu.table_name = tc.table_name
+			WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = $1 AND tc.table_name = $2
+			ORDER BY kcu.ordinal_position`, schema, table)
+	case "mysql":
+		err = db.SelectContext(ctx, &columns, `SELECT column_name FROM information_schema.key_column_usage
+			WHERE table_schema = DATABASE() AND table_name = ? AND constraint_name = 'PRIMARY'
+			ORDER BY ordinal_position`, table)
+	case "sqlite3":
+		err = db.SelectContext(ctx, &columns, `SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk`, table)
+	default:
+		err = fmt.Errorf("unsupported database type %s", config.Dbtype)
+	}
+	return columns, err
+}
+
+// contains reports whether the list holds the value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sqliteVersion caches the major and minor version of the SQLite library
+var sqliteVersion struct {
+	sync.Once
+	major, minor int
+}
+
+// sqliteAtLeast reports whether the SQLite library is at least the
+// given version
+func sqliteAtLeast(major, minor int) bool {
+	sqliteVersion.Do(func() {
+		var version string
+		if err := db.Get(&version, "SELECT sqlite_version()"); err != nil {
+			return
+		}
+		parts := strings.Split(version, ".")
+		if len(parts) < 2 {
+			return
+		}
+		sqliteVersion.major, _ = strconv.Atoi(parts[0])
+		sqliteVersion.minor, _ = strconv.Atoi(parts[1])
+	})
+	return sqliteVersion.major > major || (sqliteVersion.major == major && sqliteVersion.minor >= minor)
+}
+
+// supportsReturning reports whether INSERT ... RETURNING can be used,
+// which is the case for PostgreSQL and SQLite 3.35 or later
+func supportsReturning() bool {
+	switch config.Dbtype {
+	case "postgres":
+		return true
+	case "sqlite3":
+		return sqliteAtLeast(3, 35)
+	}
+	return false
+}
+
+// maxPlaceholders returns the number of bind parameters a single
+// statement may hold for the database type
+func maxPlaceholders() int {
+	switch config.Dbtype {
+	case "sqlite3":
+		if sqliteAtLeast(3, 32) {
+			return 32766
+		}
+		return 999
+	}
+	return 65535
+}
+
+// ResetValue returns the value that resets a column to its default, as
+// used by a full replacement PUT. PostgreSQL and MySQL accept DEFAULT in
+// an UPDATE, SQLite gets the default expression from the catalog or NULL.
+func (t *TableInfo) ResetValue(column string) interface{} {
+	if config.Dbtype != "sqlite3" {
+		return squirrel.Expr("DEFAULT")
+	}
+	if dflt, ok := t.Defaults[column]; ok {
+		return squirrel.Expr("(" + dflt + ")")
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scriptStatement is a statement of a script along with the line it
+// starts on
+type scriptStatement struct {
+	sql  string
+	line int
+}
+
+// StatementResult is the outcome of a statement of a script
+type StatementResult struct {
+	Statement int         `json:"statement"`
+	Line      int         `json:"line"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// runScript executes the statements of a script in order. With
+// __transaction__=true they run in a single transaction. With
+// __on_error__=abort, the default, the first failing statement stops the
+// script and rolls back the transaction; with __on_error__=skip failing
+// statements are reported and the script goes on.
+func runScript(r *http.Request, statements []scriptStatement, params json.RawMessage) (interface{}, *SqldError) {
+	if bytes.HasPrefix(bytes.TrimSpace(params), []byte("[")) {
+		return nil, BadRequest(errors.New("positional params need a single statement, use named params in scripts"))
+	}
+
+	args := r.URL.Query()
+	skip := false
+	switch onError := args.Get("__on_error__"); onError {
+	case "", "abort":
+	case "skip":
+		skip = true
+	default:
+		return nil, BadRequest(fmt.Errorf("invalid __on_error__ %s: expected abort or skip", onError))
+	}
+
+	var results []StatementResult
+	run := func(ex sqlx.Ext) error {
+		// Inside a transaction a failing statement must not abort the
+		// statements that follow it
+		_, nested := txOf(ex)
+		for i, stmt := range statements {
+			var data interface{}
+			var err error
+			if skip && nested {
+				err = runInTx(ex, func(tx sqlx.Ext) error {
+					data, err = runStatement(tx, stmt.sql, params)
+					return err
+				})
+			} else {
+				data, err = runStatement(ex, stmt.sql, params)
+			}
+
+			// The rows of a statement are read before the next one runs
+			if stream, ok := data.(*RowStream); ok && err == nil {
+				data, err = stream.ResultSet()
+			}
+
+			result := StatementResult{Statement: i + 1, Line: stmt.line, Data: data}
+			if err != nil {
+				if !skip {
+					sqldErr := toSqldError(err)
+					return NewError(fmt.Errorf("statement %d (line %d): %v", i+1, stmt.line, sqldErr.Err), sqldErr.Code)
+				}
+				result.Data = nil
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+		return nil
+	}
+
+	var err error
+	if args.Get("__transaction__") == "true" {
+		err = runInTx(getExecutor(r), run)
+	} else {
+		err = run(getExecutor(r))
+	}
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	return results, nil
+}
+
+// splitStatements splits a script into its statements. Delimiters inside
+// comments, literals, quoted identifiers and the BEGIN ... END body of a
+// trigger are ignored, and a DELIMITER line changes the delimiter as in
+// the mysql client. Statements holding only comments are dropped.
+func splitStatements(script string) []scriptStatement {
+	var statements []scriptStatement
+	delimiter := ";"
+	start := 0
+	firstWord := ""
+	trigger := false
+	block := 0
+
+	flush := func(end int) {
+		// Leading comments are not part of the statement
+		lead := skipComments(script, start, end)
+		if len(tokenize(script[lead:end])) > 0 {
+			statements = append(statements, scriptStatement{
+				sql:  strings.TrimSpace(script[lead:end]),
+				line: 1 + strings.Count(script[:lead], "\n"),
+			})
+		}
+		firstWord = ""
+		trigger = false
+		block = 0
+	}
+
+	for i := 0; i < len(script); {
+		// DELIMITER lines are directives of the client, not statements
+		if (i == 0 || script[i-1] == '\n') && isDelimiterDirective(script[i:]) && skipComments(script, start, i) == i {
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			if fields := strings.Fields(script[i : i+end]); len(fields) > 1 {
+				delimiter = fields[1]
+			}
+			i += end
+			start = i
+			continue
+		}
+
+		if end := scanLiteral(script, i); end > i {
+			i = end
+			continue
+		}
+
+		if block == 0 && strings.HasPrefix(script[i:], delimiter) {
+			flush(i)
+			i += len(delimiter)
+			start = i
+			continue
+		}
+
+		if isWordStart(script[i]) {
+			// A custom delimiter such as $$ ends the word, e.g. END$$
+			wordStart := i
+			for i < len(script) && isWordChar(script[i]) && (i == wordStart || !strings.HasPrefix(script[i:], delimiter)) {
+				i++
+			}
+			word := strings.ToUpper(script[wordStart:i])
+			switch {
+			case firstWord == "":
+				firstWord = word
+			case firstWord == "CREATE" && word == "TRIGGER":
+				trigger = true
+			case trigger && (word == "BEGIN" || word == "CASE"):
+				block++
+			case trigger && word == "END" && block > 0:
+				block--
+			}
+			continue
+		}
+		i++
+	}
+	flush(len(script))
+	return statements
+}
+
+// isDelimiterDirective reports whether the text starts with a DELIMITER
+// directive
+func isDelimiterDirective(text string) bool {
+	return len(text) > len("DELIMITER") &&
+		strings.EqualFold(text[:len("DELIMITER")], "DELIMITER") &&
+		(text[len("DELIMITER")] == ' ' || text[len("DELIMITER")] == '\t')
+}
+
+// skipComments returns the position of the first character between
+// start and end that is neither whitespace nor part of a comment
+func skipComments(script string, start, end int) int {
+	for start < end {
+		rest := script[start:end]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r' || rest[0] == '\n':
+			start++
+		case strings.HasPrefix(rest, "/*!") && config.Dbtype == "mysql":
+			// MySQL runs the text of the comment
+			return start
+		case strings.HasPrefix(rest, "--"), strings.HasPrefix(rest, "/*"), rest[0] == '#' && config.Dbtype == "mysql":
+			start = min(scanLiteral(script, start), end)
+		default:
+			return start
+		}
+	}
+	return end
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		dbtype     string
+		script     string
+		statements []scriptStatement
+	}{
+		{"sqlite3", "SELECT 1; SELECT 2", []scriptStatement{{"SELECT 1", 1}, {"SELECT 2", 1}}},
+		{"sqlite3", "SELECT 1;\n\nSELECT 2;\n", []scriptStatement{{"SELECT 1", 1}, {"SELECT 2", 3}}},
+		{"sqlite3", "SELECT 1;; ;\n-- done\n", []scriptStatement{{"SELECT 1", 1}}},
+		{"sqlite3", "", nil},
+
+		// Delimiters inside comments, literals and quoted identifiers
+		{"sqlite3", "SELECT ';'; SELECT 2", []scriptStatement{{"SELECT ';'", 1}, {"SELECT 2", 1}}},
+		{"sqlite3", "SELECT 'it''s;'; SELECT 2", []scriptStatement{{"SELECT 'it''s;'", 1}, {"SELECT 2", 1}}},
+		{"sqlite3", `SELECT "a;b" FROM t; SELECT 2`, []scriptStatement{{`SELECT "a;b" FROM t`, 1}, {"SELECT 2", 1}}},
+		{"sqlite3", "SELECT 1 -- ;\n; SELECT 2", []scriptStatement{{"SELECT 1 -- ;", 1}, {"SELECT 2", 2}}},
+		{"sqlite3", "/* ; */ SELECT 1", []scriptStatement{{"SELECT 1", 1}}},
+		{"sqlite3", "-- first\nSELECT 1", []scriptStatement{{"SELECT 1", 2}}},
+		{"mysql", `SELECT 'a\';b'; SELECT 2`, []scriptStatement{{`SELECT 'a\';b'`, 1}, {"SELECT 2", 1}}},
+		{"mysql", "SELECT `a;b` FROM t; SELECT 2", []scriptStatement{{"SELECT `a;b` FROM t", 1}, {"SELECT 2", 1}}},
+		{"mysql", "# ;\nSELECT 1", []scriptStatement{{"SELECT 1", 2}}},
+		{"mysql", "/*! DELETE FROM t */; SELECT 1", []scriptStatement{{"/*! DELETE FROM t */", 1}, {"SELECT 1", 1}}},
+
+		// Dollar quoted bodies
+		{"postgres", "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT f()",
+			[]scriptStatement{{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", 1}, {"SELECT f()", 1}}},
+		{"postgres", "SELECT $tag$ ; $$ ; $tag$; SELECT 2", []scriptStatement{{"SELECT $tag$ ; $$ ; $tag$", 1}, {"SELECT 2", 1}}},
+
+		// Trigger bodies
+		{"sqlite3", "CREATE TRIGGER tr AFTER INSERT ON t BEGIN UPDATE t SET x = 1; DELETE FROM u; END; SELECT 1",
+			[]scriptStatement{{"CREATE TRIGGER tr AFTER INSERT ON t BEGIN UPDATE t SET x = 1; DELETE FROM u; END", 1}, {"SELECT 1", 1}}},
+		{"sqlite3", "CREATE TRIGGER tr AFTER INSERT ON t BEGIN SELECT CASE WHEN 1 THEN 2 END; END; SELECT 1",
+			[]scriptStatement{{"CREATE TRIGGER tr AFTER INSERT ON t BEGIN SELECT CASE WHEN 1 THEN 2 END; END", 1}, {"SELECT 1", 1}}},
+
+		// DELIMITER directives
+		{"mysql", "DELIMITER $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\nDELIMITER ;\nCALL p();",
+			[]scriptStatement{{"CREATE PROCEDURE p() BEGIN SELECT 1; END", 2}, {"CALL p()", 4}}},
+		{"mysql", "DELIMITER //\nCREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN SET NEW.x = 1; END //\nDELIMITER ;\nSELECT 1",
+			[]scriptStatement{{"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN SET NEW.x = 1; END", 2}, {"SELECT 1", 4}}},
+		{"mysql", "DELIMITER $$\nSELECT '$$'$$\nDELIMITER ;",
+			[]scriptStatement{{"SELECT '$$'", 2}}},
+	}
+
+	defer func(dbtype string) { config.Dbtype = dbtype }(config.Dbtype)
+	for _, test := range tests {
+		config.Dbtype = test.dbtype
+		if statements := splitStatements(test.script); !reflect.DeepEqual(statements, test.statements) {
+			t.Errorf("%s: splitStatements(%q) = %v, want %v", test.dbtype, test.script, statements, test.statements)
+		}
+	}
+}
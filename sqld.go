@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,7 +27,8 @@ import (
 
 // RawQuery wraps the request body of a raw sqld request
 type RawQuery struct {
-	SqlQuery string `json:"sql"`
+	SqlQuery string          `json:"sql"`
+	Params   json.RawMessage `json:"params,omitempty"` // array of positional or object of named parameters
 }
 
 // SqldError provides additional information on errors encountered
@@ -41,9 +48,74 @@ type ExecResult struct {
 	RowsAffected int64 `json:"rows_affected"`
 }
 
+// Created wraps the result of a POST request, it is answered with a
+// 201 status and a Location header pointing at the created row
+type Created struct {
+	Location string
+	Data     interface{}
+}
+
+// ResultSet holds the rows returned by a query along with the column
+// order reported by the database
+type ResultSet struct {
+	Columns []string
+	Rows    []Row
+}
+
+// Row is a row returned by a query, its values in the order of the
+// columns of the query
+type Row struct {
+	Columns []string
+	Values  []interface{}
+}
+
 // EmptyArray is an empty array of maps
 var EmptyArray = []map[string]string{}
 
+// Get returns the value of a column of the row. When several columns
+// share the name, the last one wins, as in the json encoding.
+func (row Row) Get(column string) (interface{}, bool) {
+	for i := len(row.Columns) - 1; i >= 0; i-- {
+		if row.Columns[i] == column {
+			return row.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON encodes the row as an object whose keys follow the column
+// order
+func (row Row) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, column := range row.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(row.Values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// MarshalJSON encodes the result set as an array of row objects
+func (rs ResultSet) MarshalJSON() ([]byte, error) {
+	if rs.Rows == nil {
+		return json.Marshal(EmptyArray)
+	}
+	return json.Marshal(rs.Rows)
+}
+
 // Error is implemented to ensure SqldError conforms to the error
 // interface
 func (s *SqldError) Error() string {
@@ -76,6 +148,16 @@ func InternalError(err error) *SqldError {
 	return NewError(err, http.StatusInternalServerError)
 }
 
+// toSqldError keeps the status code of errors that already are a
+// SqldError and reports any other error as a bad request
+func toSqldError(err error) *SqldError {
+	var sqldErr *SqldError
+	if errors.As(err, &sqldErr) {
+		return sqldErr
+	}
+	return BadRequest(err)
+}
+
 func InitDB(config Config) (*sqlx.DB, squirrel.StatementBuilderType, error) {
 
 	sq := squirrel.StatementBuilder.PlaceholderFormat(squirrel.Question)
@@ -98,23 +180,62 @@ func CloseDB() error {
 }
 
 func parseRequest(r *http.Request) (table string, args map[string][]string, id string) {
-	paths := strings.Split(strings.TrimPrefix(r.URL.Path, config.Url), "/")
-	table = paths[0]
+	// Split the escaped path so that an escaped slash stays inside a key
+	paths := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), config.Url), "/")
+	table = unescapePath(paths[0])
 	args = r.URL.Query()
 	id = ""
 	if len(paths) > 1 {
-		id = paths[1]
+		id = unescapePath(paths[1])
 	}
 	return
 }
 
+// preference returns the value of a preference of the Prefer headers,
+// e.g. timeout=5, and whether the preference is present
+func preference(r *http.Request, name string) (string, bool) {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(prefer, ",") {
+			key, value, _ := strings.Cut(pref, "=")
+			if strings.EqualFold(strings.TrimSpace(key), name) {
+				return strings.Trim(value, "\" "), true
+			}
+		}
+	}
+	return "", false
+}
+
+// unescapePath decodes a path segment, leaving invalid escapes as is
+func unescapePath(segment string) string {
+	if unescaped, err := url.PathUnescape(segment); err == nil {
+		return unescaped
+	}
+	return segment
+}
+
 func buildSelectQuery(r *http.Request) (string, []interface{}, error) {
 	table, args, id := parseRequest(r)
+	info, err := lookupTable(r.Context(), table)
+	if err != nil {
+		return "", nil, err
+	}
 	qualifiedTable := config.GetTableName(table)
-	query := sq.Select("*").From(qualifiedTable)
+
+	columns := []string{"*"}
+	if projection, ok := args["__select__"]; ok {
+		columns, err = parseProjection(info, projection)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	query := sq.Select(columns...).From(qualifiedTable)
 
 	if id != "" {
-		query = query.Where(squirrel.Eq{"id": id})
+		keyCond, err := info.KeyCondition(id)
+		if err != nil {
+			return "", nil, err
+		}
+		query = query.Where(keyCond)
 	}
 
 	for key, val := range args {
@@ -130,9 +251,19 @@ func buildSelectQuery(r *http.Request) (string, []interface{}, error) {
 				query = query.Offset(uint64(offset))
 			}
 		case "__order_by__":
-			query = query.OrderBy(val...)
+			orderBy, err := parseOrderBy(info, val)
+			if err != nil {
+				return "", nil, err
+			}
+			query = query.OrderBy(orderBy...)
 		default:
-			query = query.Where(squirrel.Eq{key: val})
+			conditions, err := parseParam(info, key, val)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, cond := range conditions {
+				query = query.Where(cond)
+			}
 		}
 	}
 
@@ -143,22 +274,47 @@ func buildSelectQuery(r *http.Request) (string, []interface{}, error) {
 	return sql, sqlArgs, err
 }
 
+// checkFiltered refuses an UPDATE or DELETE without an id or filter,
+// unless the request has __all__=true and unfiltered mutations are
+// enabled in the configuration
+func checkFiltered(table string, args map[string][]string, filtered bool) error {
+	if filtered {
+		return nil
+	}
+	if all, ok := args["__all__"]; !ok || all[0] != "true" {
+		return BadRequest(fmt.Errorf("refusing to change every row of %s without a filter, add __all__=true to confirm", table))
+	}
+	if !config.AllowUnfiltered {
+		return BadRequest(fmt.Errorf("refusing to change every row of %s, unfiltered updates and deletes are disabled", table))
+	}
+	return nil
+}
+
 func buildUpdateQuery(r *http.Request, values map[string]interface{}) (string, []interface{}, error) {
 	table, args, id := parseRequest(r)
+	info, err := lookupTable(r.Context(), table)
+	if err != nil {
+		return "", nil, err
+	}
 	qualifiedTable := config.GetTableName(table)
 	query := sq.Update("").Table(qualifiedTable)
 
 	for key, val := range values {
-		quotedKey := fmt.Sprintf("\"%s\"", key)
-		if config.Dbtype == "mysql" {
-			quotedKey = fmt.Sprintf("`%s`", key)
+		quotedKey, err := info.QuoteColumn(key)
+		if err != nil {
+			return "", nil, err
 		}
-		query = query.SetMap(squirrel.Eq{quotedKey: val})
+		query = query.Set(quotedKey, val)
 	}
 
 	if id != "" {
-		query = query.Where(squirrel.Eq{"id": id})
+		keyCond, err := info.KeyCondition(id)
+		if err != nil {
+			return "", nil, err
+		}
+		query = query.Where(keyCond)
 	}
+	filtered := id != ""
 
 	for key, val := range args {
 		switch key {
@@ -168,21 +324,41 @@ func buildUpdateQuery(r *http.Request, values map[string]interface{}) (string, [
 				query = query.Limit(uint64(limit))
 			}
 		default:
-			query = query.Where(squirrel.Eq{key: val})
+			conditions, err := parseParam(info, key, val)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, cond := range conditions {
+				query = query.Where(cond)
+				filtered = true
+			}
 		}
 	}
 
+	if err := checkFiltered(table, args, filtered); err != nil {
+		return "", nil, err
+	}
+
 	return query.ToSql()
 }
 
 func buildDeleteQuery(r *http.Request) (string, []interface{}, error) {
 	table, args, id := parseRequest(r)
+	info, err := lookupTable(r.Context(), table)
+	if err != nil {
+		return "", nil, err
+	}
 	qualifiedTable := config.GetTableName(table)
 	query := sq.Delete("").From(qualifiedTable)
 
 	if id != "" {
-		query = query.Where(squirrel.Eq{"id": id})
+		keyCond, err := info.KeyCondition(id)
+		if err != nil {
+			return "", nil, err
+		}
+		query = query.Where(keyCond)
 	}
+	filtered := id != ""
 
 	for key, val := range args {
 		switch key {
@@ -192,114 +368,240 @@ func buildDeleteQuery(r *http.Request) (string, []interface{}, error) {
 				query = query.Limit(uint64(limit))
 			}
 		default:
-			query = query.Where(squirrel.Eq{key: val})
+			conditions, err := parseParam(info, key, val)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, cond := range conditions {
+				query = query.Where(cond)
+				filtered = true
+			}
 		}
 	}
 
+	if err := checkFiltered(table, args, filtered); err != nil {
+		return "", nil, err
+	}
+
 	return query.ToSql()
 }
 
-func readQuery(sql string, args []interface{}) ([]map[string]interface{}, error) {
-	rows, err := db.Query(sql, args...)
+func readQuery(ex sqlx.Queryer, sql string, args []interface{}) (ResultSet, error) {
+	rows, err := ex.Query(sql, args...)
 	if err != nil {
-		return nil, err
+		return ResultSet{}, err
 	}
 	defer rows.Close()
 
 	columns, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return ResultSet{}, err
 	}
 
-	count := len(columns)
-	var tableData []map[string]interface{}
-	values := make([]interface{}, count)
-	valuePtrs := make([]interface{}, count)
+	types, err := resultTypes(rows)
+	if err != nil {
+		return ResultSet{}, err
+	}
 
+	var tableData []Row
 	for rows.Next() {
-		for i := 0; i < count; i++ {
-			valuePtrs[i] = &values[i]
-		}
-		err = rows.Scan(valuePtrs...)
+		rowData, err := scanRow(rows, columns, types)
 		if err != nil {
-			return nil, err
-		}
-		rowData := make(map[string]interface{})
-		for i, col := range columns {
-			val := values[i]
-			b, ok := val.([]byte)
-
-			var v interface{}
-			if ok {
-				v = string(b)
-			} else {
-				v = val
-			}
-			rowData[col] = v
+			return ResultSet{}, err
 		}
 		tableData = append(tableData, rowData)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return ResultSet{}, err
 	}
-	return tableData, nil
+	return ResultSet{Columns: columns, Rows: tableData}, nil
+}
+
+// scanRow scans the current row of a result, converting the values to
+// the json representation of their column type
+func scanRow(rows *sql.Rows, columns []string, types []columnType) (Row, error) {
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	if err := rows.Scan(valuePtrs...); err != nil {
+		return Row{}, err
+	}
+
+	for i, value := range values {
+		values[i] = convertValue(value, types[i])
+	}
+	return Row{Columns: columns, Values: values}, nil
 }
 
 // read handles the GET request.
 func read(r *http.Request) (interface{}, *SqldError) {
 	sql, args, err := buildSelectQuery(r)
 	if err != nil {
-		return nil, BadRequest(err)
+		return nil, toSqldError(err)
+	}
+	if isDryRun(r) {
+		return dryRun(getExecutor(r), sql, args)
 	}
 
-	tableData, err := readQuery(sql, args)
+	tableData, err := readRows(getExecutor(r), sql, args)
 	if err != nil {
 		return nil, BadRequest(err)
 	}
 	return tableData, nil
 }
 
-// createSingle handles the POST method when only a single model
-// is provided in the request body.
-func createSingle(table string, item map[string]interface{}) (interface{}, error) {
-	qualifiedTable := config.GetTableName(table)
+// buildInsertQuery builds the INSERT of a single item, including the
+// upsert clause and, when supported, RETURNING *
+func buildInsertQuery(info *TableInfo, item map[string]interface{}, params map[string][]string) (squirrel.InsertBuilder, error) {
+	var err error
+	names := make([]string, len(item))
 	columns := make([]string, len(item))
 	values := make([]interface{}, len(item))
 
 	i := 0
 	for c, val := range item {
-		if config.Dbtype == "mysql" {
-			columns[i] = fmt.Sprintf("`%s`", c)
-		} else {
-			columns[i] = fmt.Sprintf("\"%s\"", c)
+		columns[i], err = info.QuoteColumn(c)
+		if err != nil {
+			return squirrel.InsertBuilder{}, err
 		}
+		names[i] = c
 		values[i] = val
 		i++
 	}
 
-	query := sq.Insert(qualifiedTable).
+	query := sq.Insert(config.GetTableName(info.Name)).
 		Columns(columns...).
 		Values(values...)
 
+	upsert, err := upsertClause(info, params, names)
+	if err != nil {
+		return squirrel.InsertBuilder{}, err
+	}
+	if upsert != "" {
+		query = query.Suffix(upsert)
+	}
+	if supportsReturning() {
+		query = query.Suffix("RETURNING *")
+	}
+	return query, nil
+}
+
+// createSingle handles the POST method when only a single model
+// is provided in the request body.
+func createSingle(ex sqlx.Ext, table string, item map[string]interface{}, params map[string][]string) (interface{}, error) {
+	info, err := lookupTable(contextOf(ex), table)
+	if err != nil {
+		return nil, err
+	}
+	qualifiedTable := config.GetTableName(table)
+
+	query, err := buildInsertQuery(info, item, params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the inserted row back in the same statement when possible
+	if supportsReturning() {
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return nil, err
+		}
+		inserted, err := readQuery(ex, sql, args)
+		if err != nil {
+			return nil, err
+		}
+		// An ignored conflict returns no row
+		if len(inserted.Rows) == 0 {
+			return ExecResult{}, nil
+		}
+		return newCreated(info, inserted.Rows[0]), nil
+	}
+
 	sql, args, err := query.ToSql()
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := db.Exec(sql, args...)
+	res, err := ex.Exec(sql, args...)
 	if err != nil {
 		return nil, err
 	}
 	rowsAffected, _ := res.RowsAffected()
-	return ExecResult{RowsAffected: rowsAffected}, nil
+
+	// Otherwise select the row by its key, taken from the item or
+	// from the generated id
+	key, ok := insertedKey(info, item, res)
+	if !ok {
+		return Created{Data: ExecResult{RowsAffected: rowsAffected}}, nil
+	}
+	sql, args, err = sq.Select("*").From(qualifiedTable).Where(key).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	selected, err := readQuery(ex, sql, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected.Rows) == 0 {
+		return Created{Data: ExecResult{RowsAffected: rowsAffected}}, nil
+	}
+	return newCreated(info, selected.Rows[0]), nil
+}
+
+// insertedKey returns the condition selecting a freshly inserted row.
+// Key columns are taken from the inserted item, a single missing key
+// column is assumed to be the auto increment column.
+func insertedKey(info *TableInfo, item map[string]interface{}, res sql.Result) (squirrel.Eq, bool) {
+	if len(info.PrimaryKey) == 0 {
+		return nil, false
+	}
+
+	key := squirrel.Eq{}
+	for _, column := range info.PrimaryKey {
+		if val, ok := item[column]; ok {
+			key[config.QuoteIdent(column)] = val
+			continue
+		}
+		if len(info.PrimaryKey) > 1 {
+			return nil, false
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, false
+		}
+		key[config.QuoteIdent(column)] = id
+	}
+	return key, true
+}
+
+// newCreated wraps an inserted row with its location
+func newCreated(info *TableInfo, row Row) Created {
+	created := Created{Data: row}
+	if len(info.PrimaryKey) == 0 {
+		return created
+	}
+
+	values := make([]string, len(info.PrimaryKey))
+	for i, column := range info.PrimaryKey {
+		value, _ := row.Get(column)
+		values[i] = url.PathEscape(fmt.Sprintf("%v", value))
+	}
+	created.Location = config.Url + url.PathEscape(info.Name) + "/" + strings.Join(values, ",")
+	return created
 }
 
 // create handles the POST method.
 func create(r *http.Request) (interface{}, *SqldError) {
-	var contentType = r.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+	case "text/csv", "text/tsv", "text/tab-separated-values":
+		return importCsv(r, contentType != "text/csv")
+	default:
 		return nil, BadRequest(errors.New("invalid content type"))
 	}
 
@@ -320,10 +622,35 @@ func create(r *http.Request) (interface{}, *SqldError) {
 	item, ok := data.(map[string]interface{})
 	if ok {
 		// Get the table name from the request path
-		table, _, _ := parseRequest(r)
-		saved, err := createSingle(table, item)
+		table, params, _ := parseRequest(r)
+		if isDryRun(r) {
+			return dryRunInsert(getExecutor(r), table, []map[string]interface{}{item}, params)
+		}
+		saved, err := createSingle(getExecutor(r), table, item, params)
 		if err != nil {
-			return nil, BadRequest(err)
+			return nil, toSqldError(err)
+		}
+		return saved, nil
+	}
+
+	// Map an array of items and create them in bulk
+	list, ok := data.([]interface{})
+	if ok {
+		items := make([]map[string]interface{}, len(list))
+		for i, element := range list {
+			item, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, BadRequest(fmt.Errorf("invalid request: item %d is not an object", i))
+			}
+			items[i] = item
+		}
+		table, params, _ := parseRequest(r)
+		if isDryRun(r) {
+			return dryRunInsert(getExecutor(r), table, items, params)
+		}
+		saved, err := createMany(getExecutor(r), table, items, params)
+		if err != nil {
+			return nil, toSqldError(err)
 		}
 		return saved, nil
 	}
@@ -331,10 +658,12 @@ func create(r *http.Request) (interface{}, *SqldError) {
 	return nil, BadRequest(errors.New("invalid request"))
 }
 
-// update handles the PUT method.
-func update(r *http.Request) (interface{}, *SqldError) {
-	var contentType = r.Header.Get("Content-Type")
-	if contentType != "application/json" {
+// readObject reads a JSON object from the request body, accepting the
+// application/json and application/merge-patch+json content types. The
+// object may be empty.
+func readObject(r *http.Request) (map[string]interface{}, *SqldError) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/json" && contentType != "application/merge-patch+json" {
 		return nil, BadRequest(errors.New("invalid content type"))
 	}
 
@@ -348,14 +677,110 @@ func update(r *http.Request) (interface{}, *SqldError) {
 	if err := json.Unmarshal(body, &data); err != nil {
 		return nil, BadRequest(err)
 	}
+	if data == nil {
+		return nil, BadRequest(errors.New("expected a json object"))
+	}
+	return data, nil
+}
 
-	sql, args, err := buildUpdateQuery(r, data)
+// update handles the PUT method, which replaces the row identified by
+// the path. Columns missing from the body are reset to their default
+// or NULL, so an empty object resets every column but the key. With
+// __upsert__=true a missing row is created.
+func update(r *http.Request) (interface{}, *SqldError) {
+	data, sqldErr := readObject(r)
+	if sqldErr != nil {
+		return nil, sqldErr
+	}
 
+	table, args, id := parseRequest(r)
+	if id == "" {
+		return nil, BadRequest(errors.New("PUT replaces a single row, use PATCH to update rows by filter"))
+	}
+	info, err := lookupTable(r.Context(), table)
 	if err != nil {
-		return nil, BadRequest(err)
+		return nil, toSqldError(err)
+	}
+
+	values := make(map[string]interface{}, len(info.Columns))
+	for _, column := range info.Columns {
+		if contains(info.PrimaryKey, column) {
+			continue
+		}
+		values[column] = info.ResetValue(column)
+	}
+	for column, val := range data {
+		values[column] = val
+	}
+
+	sql, sqlArgs, err := buildUpdateQuery(r, values)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	if isDryRun(r) {
+		return dryRun(getExecutor(r), sql, sqlArgs)
 	}
 
-	return execQuery(sql, args)
+	result, sqldErr := execQuery(getExecutor(r), sql, sqlArgs)
+	if sqldErr != nil || result.(ExecResult).RowsAffected > 0 {
+		return result, sqldErr
+	}
+	if upsert, ok := args["__upsert__"]; !ok || upsert[0] != "true" {
+		return result, nil
+	}
+
+	// MySQL reports 0 rows affected when nothing changed, so only
+	// create the row when it does not exist
+	keyCond, err := info.KeyCondition(id)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	sql, sqlArgs, err = sq.Select("1").From(config.GetTableName(table)).Where(keyCond).ToSql()
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	existing, err := readQuery(getExecutor(r), sql, sqlArgs)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	if len(existing.Rows) > 0 {
+		return result, nil
+	}
+
+	keyValues := strings.Split(id, ",")
+	for i, column := range info.PrimaryKey {
+		if _, ok := data[column]; !ok {
+			data[column] = keyValues[i]
+		}
+	}
+	created, err := createSingle(getExecutor(r), table, data, nil)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	return created, nil
+}
+
+// patch handles the PATCH method, a partial update following JSON Merge
+// Patch semantics: only the columns in the body are changed and a null
+// value clears the column.
+func patch(r *http.Request) (interface{}, *SqldError) {
+	data, sqldErr := readObject(r)
+	if sqldErr != nil {
+		return nil, sqldErr
+	}
+	if len(data) == 0 {
+		return nil, BadRequest(errors.New("empty request"))
+	}
+
+	sql, args, err := buildUpdateQuery(r, data)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	if isDryRun(r) {
+		return dryRun(getExecutor(r), sql, args)
+	}
+
+	return execQuery(getExecutor(r), sql, args)
 }
 
 // del handles the DELETE method.
@@ -363,54 +788,60 @@ func del(r *http.Request) (interface{}, *SqldError) {
 	sql, args, err := buildDeleteQuery(r)
 
 	if err != nil {
-		return nil, BadRequest(err)
+		return nil, toSqldError(err)
+	}
+	if isDryRun(r) {
+		return dryRun(getExecutor(r), sql, args)
 	}
 
-	return execQuery(sql, args)
+	return execQuery(getExecutor(r), sql, args)
 }
 
 // execQuery will perform a sql query, return the appropriate error code
 // given error states or return an http 204 NO CONTENT on success.
-func execQuery(sql string, args []interface{}) (interface{}, *SqldError) {
-	res, err := db.Exec(sql, args...)
-	if err != nil {
-		return nil, BadRequest(err)
+// When a maximum of affected rows is configured, the query runs in a
+// transaction that is rolled back if it affects more rows.
+func execQuery(ex sqlx.Ext, sql string, args []interface{}) (interface{}, *SqldError) {
+	if config.MaxAffected <= 0 {
+		res, err := ex.Exec(sql, args...)
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return nil, BadRequest(err)
+		}
+
+		return ExecResult{RowsAffected: rowsAffected}, nil
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	var rowsAffected int64
+	err := runInTx(ex, func(tx sqlx.Ext) error {
+		res, err := tx.Exec(sql, args...)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected > config.MaxAffected {
+			return fmt.Errorf("query would affect %d rows, more than the maximum of %d, rolled back", rowsAffected, config.MaxAffected)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, BadRequest(err)
+		return nil, toSqldError(err)
 	}
-
 	return ExecResult{RowsAffected: rowsAffected}, nil
 }
 
-// detectQueryType determines if the SQL query is a read or write operation
-func detectQueryType(query string) string {
-	var firstWord = strings.Split(query, " ")[0]
-	var action = strings.TrimSpace(strings.ToUpper(firstWord))
-	if action == "SELECT" ||
-		action == "SHOW" ||
-		action == "DESCRIBE" ||
-		action == "EXPLAIN" ||
-		action == "DESC" ||
-		action == "PRAGMA" {
-		return "read"
-	}
-	if action == "INSERT" ||
-		action == "UPDATE" ||
-		action == "DELETE" ||
-		action == "CREATE" ||
-		action == "DROP" ||
-		action == "ALTER" {
-		return "write"
-	}
-	return "unknown"
-}
-
-// Execute a raw query
-// Suport content type application/json and text/plain, application/json is default
-// Type of action will be detected by the first word of the query
+// raw executes a raw query. The query is read from an application/json
+// or text/plain body, or from the sql field or file of a urlencoded or
+// multipart form; other content types are refused. The type of action is
+// detected by classifying the statement, a script of several statements
+// is answered with the result of each statement.
 func raw(r *http.Request) (interface{}, *SqldError) {
 	var query RawQuery
 
@@ -443,6 +874,11 @@ func raw(r *http.Request) (interface{}, *SqldError) {
 			query.SqlQuery = r.PostFormValue("sql")
 		}
 
+		// Parameters are given as json text
+		if params := r.FormValue("params"); params != "" {
+			query.Params = json.RawMessage(params)
+		}
+
 		// Read from form file
 		if query.SqlQuery == "" && r.MultipartForm != nil {
 			sqlFile := r.MultipartForm.File["sql"]
@@ -474,27 +910,67 @@ func raw(r *http.Request) (interface{}, *SqldError) {
 		return nil, BadRequest(errors.New("empty query"))
 	}
 
-	// Execute the query
-	var noArgs []interface{}
-	var queryType = detectQueryType(query.SqlQuery)
-	if queryType == "read" {
-		tableData, err := readQuery(query.SqlQuery, noArgs)
-		if err != nil {
-			return nil, BadRequest(err)
-		}
-		return tableData, nil
+	// Split scripts into statements
+	statements := splitStatements(query.SqlQuery)
+	if len(statements) == 0 {
+		return nil, BadRequest(errors.New("empty query"))
+	}
+	if len(statements) > 1 {
+		return runScript(r, statements, query.Params)
 	}
-	if queryType == "write" {
-		res, err := db.Exec(query.SqlQuery, noArgs...)
+
+	data, err := runStatement(getExecutor(r), statements[0].sql, query.Params)
+	if err != nil {
+		return nil, toSqldError(err)
+	}
+	return data, nil
+}
+
+// runStatement binds the parameters of a single statement and executes
+// it. Statements returning rows are answered with the rows, others with
+// the number of affected rows.
+func runStatement(ex sqlx.Ext, query string, params json.RawMessage) (interface{}, error) {
+	bound, args, err := bindParams(query, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var stmt = classifyStatement(query)
+	if stmt.Kind == "" {
+		// If the query type is unknown, return a bad request
+		return nil, errors.New("unknown query type")
+	}
+	if !config.AllowsStatement(stmt.Kind) {
+		return nil, NewError(fmt.Errorf("%s statements are not allowed in raw mode %s", stmt.Kind, config.RawMode), http.StatusForbidden)
+	}
+	if stmt.Kind == ddlStatement {
+		// The statement may change the schema
+		defer invalidateSchema()
+	}
+
+	// A read only transaction also stops writes hidden from the
+	// classifier, such as functions with side effects
+	if config.RawMode == rawModeReadonly && (config.Dbtype == "postgres" || config.Dbtype == "mysql") {
+		if _, nested := txOf(ex); nested {
+			return nil, NewError(errors.New("raw queries cannot run inside a transaction in raw mode readonly"), http.StatusForbidden)
+		}
+		tx, txEx, err := newTx(ex, &sql.TxOptions{ReadOnly: true})
 		if err != nil {
-			return nil, BadRequest(err)
+			return nil, InternalError(err)
 		}
-		rAffect, _ := res.RowsAffected()
-		return ExecResult{RowsAffected: rAffect}, nil
+		defer tx.Rollback()
+		ex = txEx
 	}
 
-	// If the query type is unknown, return a bad request
-	return nil, BadRequest(errors.New("unknown query type"))
+	if stmt.ReturnsRows {
+		return readRows(ex, bound, args)
+	}
+	res, err := ex.Exec(bound, args...)
+	if err != nil {
+		return nil, err
+	}
+	rAffect, _ := res.RowsAffected()
+	return ExecResult{RowsAffected: rAffect}, nil
 }
 
 func logRequest(r *http.Request, status int, start time.Time) {
@@ -516,15 +992,23 @@ func logRequest(r *http.Request, status int, start time.Time) {
 	)
 }
 
-func quoteMinimal(field string) string {
-	if strings.ContainsAny(field, ",\"\n") {
-		return strconv.Quote(field)
+// mapColumns returns the sorted keys of all the items, so that rows
+// missing some keys keep the same columns
+func mapColumns(items []map[string]interface{}) []string {
+	var columns []string
+	for _, item := range items {
+		for key := range item {
+			if !contains(columns, key) {
+				columns = append(columns, key)
+			}
+		}
 	}
-	return field
+	sort.Strings(columns)
+	return columns
 }
 
 // writeResponseCsv writes the response to the client in csv format
-func writeResponseCsv(w http.ResponseWriter, acceptHeader string, data interface{}, err *SqldError) int {
+func writeResponseCsv(w http.ResponseWriter, opts csvOptions, status int, data interface{}, err *SqldError) int {
 	// If an error occurred, write the error to the response
 	if err != nil {
 		http.Error(w, err.Error(), err.Code)
@@ -533,112 +1017,137 @@ func writeResponseCsv(w http.ResponseWriter, acceptHeader string, data interface
 
 	// If no data was returned, write a 200 OK response
 	if data == nil {
-		w.WriteHeader(http.StatusOK)
-		return http.StatusOK
+		w.WriteHeader(status)
+		return status
 	}
 
-	// write csv response
-	seperator := ","
-	contentType := "text/csv"
-	if acceptHeader == "text/tsv" {
-		seperator = "\t"
-		contentType = "text/tsv"
-	}
-	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Type", opts.contentType())
 
-	rv := reflect.ValueOf(data)
-	if rv.Kind() == reflect.Struct {
-		w.WriteHeader(http.StatusOK)
-		if result, ok := data.(ExecResult); ok {
-			w.Write([]byte("rows_affected\n"))
-			w.Write([]byte(fmt.Sprintf("%v\n", result.RowsAffected)))
-		}
-		return http.StatusOK
-	}
-
-	if rv.IsNil() {
-		w.WriteHeader(http.StatusOK)
-		return http.StatusOK
-	}
-
-	// if data is basic type, return 200 OK
-	if rv.Kind() == reflect.String || rv.Kind() == reflect.Int || rv.Kind() == reflect.Float64 {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("%v", data)))
-		return http.StatusOK
-	}
-
-	// if data is a map, return 200 OK
-	if rv.Kind() == reflect.Map {
-		// get the headers
-		w.WriteHeader(http.StatusOK)
-		var headers []string
-		for key := range data.(map[string]interface{}) {
-			headers = append(headers, key)
-		}
-		w.Write([]byte(strings.Join(headers, seperator) + "\n"))
-		// get the values
-		var row []string
-		for _, header := range headers {
-			val := data.(map[string]interface{})[header]
-			valStr := fmt.Sprintf("%v", val)
-			if val == nil {
-				valStr = "null"
-			}
-			row = append(row, quoteMinimal(valStr))
+	var columns []string
+	var rows [][]interface{}
+	switch d := data.(type) {
+	case ResultSet:
+		// query results keep the column order of the select
+		columns = d.Columns
+		for _, row := range d.Rows {
+			rows = append(rows, row.Values)
 		}
-		w.Write([]byte(strings.Join(row, seperator) + "\n"))
-		return http.StatusOK
-	}
-
-	// if data is a slice or array, return 200 OK
-	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
-		// if data is empty, return 200 OK
-		if rv.Len() == 0 {
-			w.WriteHeader(http.StatusOK)
-			return http.StatusOK
+	case Row:
+		columns, rows = d.Columns, [][]interface{}{d.Values}
+	case ExecResult:
+		columns, rows = []string{"rows_affected"}, [][]interface{}{{d.RowsAffected}}
+	case ImportResult:
+		columns, rows = []string{"rows_affected"}, [][]interface{}{{d.RowsAffected}}
+	case BulkResult:
+		columns, rows = []string{"rows_affected"}, [][]interface{}{{d.RowsAffected}}
+	case string, int, float64:
+		w.WriteHeader(status)
+		w.Write([]byte(fmt.Sprintf("%v", d)))
+		return status
+	case map[string]interface{}, []map[string]interface{}:
+		// maps have no column order, their keys are sorted
+		items, ok := d.([]map[string]interface{})
+		if !ok {
+			items = []map[string]interface{}{d.(map[string]interface{})}
 		}
-
-		// get the first element of the slice to get the headers
-		w.WriteHeader(http.StatusOK)
-		var headers []string
-		for key := range rv.Index(0).Interface().(map[string]interface{}) {
-			headers = append(headers, key)
+		if len(items) == 0 {
+			w.WriteHeader(status)
+			return status
 		}
-		w.Write([]byte(strings.Join(headers, seperator) + "\n"))
-
-		// write the data
-		for _, item := range data.([]map[string]interface{}) {
-			var row []string
-			for _, header := range headers {
-				val := item[header]
-				valStr := fmt.Sprintf("%v", val)
-				if val == nil {
-					valStr = "null"
-				}
-				row = append(row, quoteMinimal(valStr))
+		columns = mapColumns(items)
+		for _, item := range items {
+			values := make([]interface{}, len(columns))
+			for i, column := range columns {
+				values[i] = item[column]
 			}
-			w.Write([]byte(strings.Join(row, seperator) + "\n"))
+			rows = append(rows, values)
+		}
+	default:
+		if rv := reflect.ValueOf(data); rv.Kind() != reflect.Struct && rv.IsNil() {
+			w.WriteHeader(status)
+			return status
 		}
+		// Data that is not a table, e.g. a dry run or the results of a
+		// batch, is answered in json
+		return writeResponseJson(w, status, data, nil)
+	}
 
-		return http.StatusOK
+	w.WriteHeader(status)
+	opts.writeRows(w, columns, rows)
+	return status
+}
+
+// writeResponseNdjson writes the response to the client as json lines:
+// one line per row of a result or element of a list, a single line for
+// other data and errors
+func writeResponseNdjson(w http.ResponseWriter, status int, data interface{}, err *SqldError) int {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+
+	// If an error occurred, write the error to the response
+	if err != nil {
+		errStr := err.Error()
+		w.WriteHeader(err.Code)
+		encoder.Encode(Response{
+			Error: &errStr,
+		})
+		return err.Code
 	}
 
-	return http.StatusInternalServerError
+	w.WriteHeader(status)
+	switch d := data.(type) {
+	case nil:
+	case ResultSet:
+		for _, row := range d.Rows {
+			encoder.Encode(row)
+		}
+	default:
+		rv := reflect.ValueOf(data)
+		if rv.Kind() != reflect.Slice {
+			encoder.Encode(data)
+			break
+		}
+		for i := 0; i < rv.Len(); i++ {
+			encoder.Encode(rv.Index(i).Interface())
+		}
+	}
+	return status
 }
 
 // writeResponse writes the response to the client,
-// accept 2 response types, text(csv) or json
-// if request does not send accept header, default response is json
+// accept 4 response types, csv, tsv, json lines or json, following
+// the Accept header, the default response is json
 func writeResponse(w http.ResponseWriter, r *http.Request, data interface{}, err *SqldError) int {
-	var acceptHeader = r.Header.Get("Accept")
+	// rows read on the database are encoded as they are read
+	if stream, ok := data.(*RowStream); ok {
+		return writeStream(w, r, stream)
+	}
 
-	// accept csv and tsv
-	if acceptHeader == "text/csv" || acceptHeader == "text/tsv" {
-		return writeResponseCsv(w, acceptHeader, data, err)
+	// created rows are answered with 201 and their location
+	status := http.StatusOK
+	if created, ok := data.(Created); ok {
+		if created.Location != "" {
+			w.Header().Set("Location", created.Location)
+		}
+		status = http.StatusCreated
+		data = created.Data
+	}
+
+	// accept csv, tsv and json lines
+	switch negotiateType(r) {
+	case "text/csv", "text/tsv":
+		opts, _ := parseCsvOptions(r)
+		return writeResponseCsv(w, opts, status, data, err)
+	case "application/x-ndjson":
+		return writeResponseNdjson(w, status, data, err)
 	}
 
 	// default response is json
+	return writeResponseJson(w, status, data, err)
+}
+
+// writeResponseJson writes the response to the client in json format
+func writeResponseJson(w http.ResponseWriter, status int, data interface{}, err *SqldError) int {
 	w.Header().Set("Content-Type", "application/json")
 
 	// If an error occurred, write the error to the response
@@ -658,9 +1167,45 @@ func writeResponse(w http.ResponseWriter, r *http.Request, data interface{}, err
 	}
 
 	// Write data to the response
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
-	return http.StatusOK
+	return status
+}
+
+// route dispatches a table request to the handler of its method
+func route(r *http.Request) (interface{}, *SqldError) {
+	switch r.Method {
+	case "GET":
+		return read(r)
+	case "POST":
+		return create(r)
+	case "PUT":
+		return update(r)
+	case "PATCH":
+		return patch(r)
+	case "DELETE":
+		return del(r)
+	}
+	return nil, &SqldError{http.StatusMethodNotAllowed, errors.New("MethodNotAllowed")}
+}
+
+// handle dispatches a request to the raw, batch, saved query or table
+// handlers
+func handle(r *http.Request) (interface{}, *SqldError) {
+	if config.IsBaseUrl(r.URL.Path) {
+		return raw(r)
+	}
+	table, _, id := parseRequest(r)
+	if table == "_batch" && id == "" {
+		if r.Method != "POST" {
+			return nil, &SqldError{http.StatusMethodNotAllowed, errors.New("MethodNotAllowed")}
+		}
+		return batch(r)
+	}
+	if table == "_query" {
+		return savedQuery(r)
+	}
+	return route(r)
 }
 
 // handleQuery routes the given request to the proper handler
@@ -671,32 +1216,38 @@ func HandleQuery(w http.ResponseWriter, r *http.Request) {
 	var err *SqldError
 	var data interface{}
 	start := time.Now()
-	if config.IsBaseUrl(r.URL.Path) {
-		if config.AllowRaw && r.Method == "POST" {
-			data, err = raw(r)
+	if config.IsBaseUrl(r.URL.Path) && !(config.AllowRaw && r.Method == "POST") {
+		// Health check
+		if db.Ping() == nil {
+			w.WriteHeader(http.StatusOK)
 		} else {
-			// Health check
-			start := time.Now()
-			if db.Ping() == nil {
-				w.WriteHeader(http.StatusOK)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			logRequest(r, http.StatusOK, start)
-			return
+			w.WriteHeader(http.StatusInternalServerError)
 		}
-	} else {
-		switch r.Method {
-		case "GET":
-			data, err = read(r)
-		case "POST":
-			data, err = create(r)
-		case "PUT":
-			data, err = update(r)
-		case "DELETE":
-			data, err = del(r)
-		default:
-			err = &SqldError{http.StatusMethodNotAllowed, errors.New("MethodNotAllowed")}
+		logRequest(r, http.StatusOK, start)
+		return
+	}
+
+	// The queries of the request stop when it times out or the client
+	// goes away
+	timeout, err := requestTimeout(r)
+	if err == nil {
+		// Invalid csv options are refused before any query runs
+		_, err = parseCsvOptions(r)
+	}
+	if err == nil {
+		var cancel context.CancelFunc
+		r, cancel = withTimeout(r, timeout)
+		defer cancel()
+
+		if table, _, _ := parseRequest(r); table == "_tx" {
+			data, err = transaction(r)
+		} else if token := r.Header.Get(txHeader); token != "" {
+			data, err = inTransaction(r, token)
+		} else {
+			data, err = handle(r)
+		}
+		if err != nil && r.Context().Err() != nil {
+			err = contextError(r.Context())
 		}
 	}
 
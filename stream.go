@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// streamErrorTrailer is the trailer reporting an error that occurred
+// after the rows of a stream started to be written
+const streamErrorTrailer = "X-Sqld-Error"
+
+// Streamed rows are flushed to the client every streamFlushRows rows or
+// every streamFlushInterval, whichever comes first
+const (
+	streamFlushRows     = 1000
+	streamFlushInterval = 200 * time.Millisecond
+)
+
+// RowStream holds the open rows of a query, which are encoded into the
+// response as they are read instead of being held in memory
+type RowStream struct {
+	rows    *sql.Rows
+	Columns []string
+	types   []columnType
+}
+
+// readRows runs a query returning rows. On the database the rows are
+// returned as a RowStream. Inside a transaction they are read into a
+// ResultSet, as the transaction must not be used once the handler of the
+// request returns.
+func readRows(ex sqlx.Ext, sql string, args []interface{}) (interface{}, error) {
+	if _, nested := txOf(ex); nested {
+		return readQuery(ex, sql, args)
+	}
+
+	rows, err := ex.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	types, err := resultTypes(rows)
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return &RowStream{rows: rows, Columns: columns, types: types}, nil
+}
+
+// Next returns the next row of the stream, ok is false once the rows
+// are exhausted
+func (s *RowStream) Next() (row Row, ok bool, err error) {
+	if !s.rows.Next() {
+		return Row{}, false, s.rows.Err()
+	}
+	row, err = scanRow(s.rows, s.Columns, s.types)
+	return row, err == nil, err
+}
+
+// Close releases the rows and their connection
+func (s *RowStream) Close() error {
+	return s.rows.Close()
+}
+
+// ResultSet reads the remaining rows of the stream and closes it
+func (s *RowStream) ResultSet() (ResultSet, error) {
+	defer s.Close()
+	rs := ResultSet{Columns: s.Columns}
+	for {
+		row, ok, err := s.Next()
+		if err != nil {
+			return ResultSet{}, err
+		}
+		if !ok {
+			return rs, nil
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+}
+
+// writeStream writes the rows of a stream as a json array, or as csv,
+// tsv or json lines following the Accept header. An error reading the
+// first row is answered with an error response. The status is sent once
+// the first row is read, so a later error is reported in the
+// X-Sqld-Error trailer; a json array is then left unterminated, so that
+// the partial rows cannot be taken for the whole result.
+func writeStream(w http.ResponseWriter, r *http.Request, stream *RowStream) int {
+	defer stream.Close()
+
+	// Most errors of a query, e.g. a timeout, occur on reading its first
+	// row, which is read before the status is sent
+	row, ok, err := stream.Next()
+	if err != nil {
+		return writeResponse(w, r, nil, streamError(r, err))
+	}
+
+	var encoder rowEncoder
+	switch responseType := negotiateType(r); responseType {
+	case "text/csv", "text/tsv":
+		opts, _ := parseCsvOptions(r)
+		w.Header().Set("Content-Type", opts.contentType())
+		encoder = &csvEncoder{opts: opts, w: w}
+	case "application/x-ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder = &ndjsonEncoder{w: w}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		encoder = &jsonEncoder{w: w}
+	}
+	w.Header().Set("Trailer", streamErrorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	count, unflushed := 0, 0
+	lastFlush := time.Now()
+
+	err = encoder.begin(stream.Columns)
+	for err == nil && ok {
+		err = encoder.row(row)
+		count++
+		unflushed++
+
+		if err == nil && (unflushed >= streamFlushRows || time.Since(lastFlush) >= streamFlushInterval) {
+			if err = encoder.flush(); err == nil {
+				rc.Flush()
+			}
+			unflushed, lastFlush = 0, time.Now()
+		}
+		if err == nil {
+			row, ok, err = stream.Next()
+		}
+	}
+	if err == nil {
+		err = encoder.end()
+	}
+
+	if err != nil {
+		message := streamError(r, err).Error()
+		w.Header().Set(streamErrorTrailer, message)
+		log.Printf("Streaming failed after %d rows: %s", count, message)
+	}
+	return http.StatusOK
+}
+
+// streamError maps an error of a stream onto an error response, the end
+// of the request context taking precedence over the error of the driver
+func streamError(r *http.Request, err error) *SqldError {
+	if r.Context().Err() != nil {
+		return contextError(r.Context())
+	}
+	return BadRequest(err)
+}
+
+// rowEncoder encodes the rows of a stream into a response format
+type rowEncoder interface {
+	begin(columns []string) error
+	row(row Row) error
+	flush() error // writes out the buffered rows
+	end() error
+}
+
+// jsonEncoder encodes rows as a json array of objects
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonEncoder) begin(columns []string) error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonEncoder) row(row Row) error {
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		encoded = append([]byte(","), encoded...)
+	}
+	e.count++
+	_, err = e.w.Write(encoded)
+	return err
+}
+
+func (e *jsonEncoder) flush() error {
+	return nil
+}
+
+func (e *jsonEncoder) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// ndjsonEncoder encodes rows as json lines, one object per line
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+func (e *ndjsonEncoder) begin(columns []string) error {
+	return nil
+}
+
+func (e *ndjsonEncoder) row(row Row) error {
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(encoded, '\n'))
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+func (e *ndjsonEncoder) end() error {
+	return nil
+}
+
+// csvEncoder encodes rows as the lines of a csv or tsv response
+type csvEncoder struct {
+	opts csvOptions
+	w    io.Writer
+	cw   *csv.Writer
+}
+
+func (e *csvEncoder) begin(columns []string) error {
+	cw, err := e.opts.newWriter(e.w)
+	if err != nil {
+		return err
+	}
+	e.cw = cw
+	if e.opts.header {
+		return e.cw.Write(columns)
+	}
+	return nil
+}
+
+func (e *csvEncoder) row(row Row) error {
+	return e.cw.Write(e.opts.record(row.Values))
+}
+
+func (e *csvEncoder) flush() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+func (e *csvEncoder) end() error {
+	return e.flush()
+}
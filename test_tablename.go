@@ -13,12 +13,13 @@ func testTableName() {
 		tableName string
 		expected  string
 	}{
-		{"postgres", "public", "actions", "actions"},                // lowercase, public schema
-		{"postgres", "public", "Actions", "\"Actions\""},            // uppercase, public schema
-		{"postgres", "myschema", "actions", "myschema.actions"},     // lowercase, custom schema
-		{"postgres", "myschema", "Actions", "myschema.\"Actions\""}, // uppercase, custom schema
-		{"mysql", "", "Actions", "Actions"},                         // MySQL should not quote
-		{"sqlite3", "", "Actions", "Actions"},                       // SQLite should not quote
+		{"postgres", "public", "actions", "\"actions\""},                // lowercase, public schema
+		{"postgres", "public", "Actions", "\"Actions\""},                // uppercase, public schema
+		{"postgres", "myschema", "actions", "\"myschema\".\"actions\""}, // lowercase, custom schema
+		{"postgres", "myschema", "Actions", "\"myschema\".\"Actions\""}, // uppercase, custom schema
+		{"postgres", "public", "odd\"name", "\"odd\"\"name\""},          // embedded quote is doubled
+		{"mysql", "", "Actions", "`Actions`"},                           // MySQL uses backticks
+		{"sqlite3", "", "Actions", "\"Actions\""},                       // SQLite uses double quotes
 	}
 
 	for _, tc := range testCases {
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusClientClosedRequest is the non standard status of a request
+// cancelled by the client
+const statusClientClosedRequest = 499
+
+// timeoutKey is the request context key of the timeout of a request
+type timeoutKey struct{}
+
+// requestTimeout returns the time the queries of a request may take:
+// the __timeout__ parameter or the Prefer: timeout= header, capped by
+// the -query-timeout setting, which also is the default. Zero means no
+// timeout.
+func requestTimeout(r *http.Request) (time.Duration, *SqldError) {
+	value := r.URL.Query().Get("__timeout__")
+	if value == "" {
+		value, _ = preference(r, "timeout")
+	}
+
+	timeout := config.QueryTimeout
+	if value == "" {
+		return timeout, nil
+	}
+	requested, err := parseTimeout(value)
+	if err != nil {
+		return 0, BadRequest(err)
+	}
+	if timeout == 0 || requested < timeout {
+		timeout = requested
+	}
+	return timeout, nil
+}
+
+// parseTimeout parses a timeout given in seconds, e.g. 2.5, or as a
+// duration, e.g. 500ms
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if seconds, floatErr := strconv.ParseFloat(value, 64); floatErr == nil {
+		timeout, err = time.Duration(seconds*float64(time.Second)), nil
+	}
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s: expected seconds or a duration such as 500ms", value)
+	}
+	return timeout, nil
+}
+
+// withTimeout returns a shallow copy of the request whose context ends
+// after the timeout, if any
+func withTimeout(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx := context.WithValue(r.Context(), timeoutKey{}, timeout)
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return r.WithContext(ctx), cancel
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// contextError maps the end of a request context onto an error response:
+// 504 when the queries timed out and 499 when the client went away
+func contextError(ctx context.Context) *SqldError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		timeout, _ := ctx.Value(timeoutKey{}).(time.Duration)
+		return NewError(fmt.Errorf("query timed out after %s", timeout), http.StatusGatewayTimeout)
+	}
+	return NewError(errors.New("request cancelled by the client"), statusClientClosedRequest)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// txHeader is the request header carrying the token of the open
+// transaction a request runs in
+const txHeader = "X-Sqld-Tx"
+
+// Transaction describes an interactive transaction
+type Transaction struct {
+	Token       string `json:"token"`
+	Status      string `json:"status"`
+	IdleTimeout int64  `json:"idle_timeout,omitempty"` // seconds
+}
+
+// openTx is an interactive transaction. Its mutex serializes the
+// requests running in it, as a sqlx.Tx must not be used concurrently.
+type openTx struct {
+	sync.Mutex
+	tx    *sqlx.Tx
+	timer *time.Timer
+	done  bool
+}
+
+// transactions holds the open interactive transactions by token,
+// pending counts the transactions being started
+var transactions = struct {
+	sync.Mutex
+	open    map[string]*openTx
+	pending int
+}{open: map[string]*openTx{}}
+
+// transaction handles {base}/_tx: POST /_tx begins a transaction,
+// POST /_tx/{token}/commit and POST /_tx/{token}/rollback end it
+func transaction(r *http.Request) (interface{}, *SqldError) {
+	if r.Method != "POST" {
+		return nil, &SqldError{http.StatusMethodNotAllowed, errors.New("MethodNotAllowed")}
+	}
+
+	paths := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, config.Url+"_tx"), "/"), "/")
+	switch {
+	case len(paths) == 1 && paths[0] == "":
+		return beginTx(r)
+	case len(paths) == 2 && paths[1] == "commit":
+		return endTx(paths[0], true)
+	case len(paths) == 2 && paths[1] == "rollback":
+		return endTx(paths[0], false)
+	}
+	return nil, NotFound(errors.New("unknown transaction action"))
+}
+
+// beginTx starts an interactive transaction, refusing to do so when the
+// maximum number of open transactions is reached. The transaction
+// outlives the request, so it is not rolled back when the request ends.
+func beginTx(r *http.Request) (interface{}, *SqldError) {
+	transactions.Lock()
+	if len(transactions.open)+transactions.pending >= config.MaxTx {
+		transactions.Unlock()
+		return nil, NewError(fmt.Errorf("too many open transactions, the maximum is %d", config.MaxTx), http.StatusServiceUnavailable)
+	}
+	transactions.pending++
+	transactions.Unlock()
+
+	tx, err := db.BeginTxx(context.WithoutCancel(r.Context()), nil)
+
+	transactions.Lock()
+	defer transactions.Unlock()
+	transactions.pending--
+	if err != nil {
+		return nil, InternalError(err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		tx.Rollback()
+		return nil, InternalError(err)
+	}
+	t := &openTx{tx: tx}
+	t.timer = time.AfterFunc(config.TxTimeout, func() { expireTx(token) })
+	transactions.open[token] = t
+
+	return Created{
+		Location: config.Url + "_tx/" + token,
+		Data:     Transaction{Token: token, Status: "open", IdleTimeout: int64(config.TxTimeout / time.Second)},
+	}, nil
+}
+
+// endTx commits or rolls back an interactive transaction
+func endTx(token string, commit bool) (interface{}, *SqldError) {
+	t := takeTx(token)
+	if t == nil {
+		return nil, NotFound(fmt.Errorf("transaction %s not found", token))
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.done {
+		return nil, NotFound(fmt.Errorf("transaction %s not found", token))
+	}
+	t.timer.Stop()
+	t.done = true
+
+	if !commit {
+		if err := t.tx.Rollback(); err != nil {
+			return nil, InternalError(err)
+		}
+		return Transaction{Token: token, Status: "rolled back"}, nil
+	}
+	if err := t.tx.Commit(); err != nil {
+		return nil, BadRequest(err)
+	}
+	return Transaction{Token: token, Status: "committed"}, nil
+}
+
+// expireTx rolls back a transaction that stayed idle for too long
+func expireTx(token string) {
+	t := takeTx(token)
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	t.tx.Rollback()
+	log.Printf("Transaction %s idle for %s, rolled back", token, config.TxTimeout)
+}
+
+// takeTx removes a transaction from the open transactions, so that no
+// new request can run in it
+func takeTx(token string) *openTx {
+	transactions.Lock()
+	defer transactions.Unlock()
+	t := transactions.open[token]
+	delete(transactions.open, token)
+	return t
+}
+
+// inTransaction runs a request inside the open transaction of the token.
+// The idle timer is stopped while the request runs.
+func inTransaction(r *http.Request, token string) (interface{}, *SqldError) {
+	transactions.Lock()
+	t := transactions.open[token]
+	transactions.Unlock()
+	if t == nil {
+		return nil, NotFound(fmt.Errorf("transaction %s not found", token))
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	// The timer already fired when it cannot be stopped
+	if t.done || !t.timer.Stop() {
+		return nil, NotFound(fmt.Errorf("transaction %s not found", token))
+	}
+	defer t.timer.Reset(config.TxTimeout)
+
+	return handle(withExecutor(r, t.tx))
+}
+
+// newToken returns a random transaction token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// upsertClause builds the conflict handling suffix of an INSERT from the
+// __on_conflict__ and __resolution__ parameters. The conflict columns
+// default to the primary key and the resolution defaults to merge. It
+// returns an empty clause when the request asks for a plain insert.
+func upsertClause(info *TableInfo, args map[string][]string, columns []string) (string, error) {
+	onConflict, hasConflict := args["__on_conflict__"]
+	resolution, hasResolution := args["__resolution__"]
+	if !hasConflict && !hasResolution {
+		return "", nil
+	}
+
+	merge := true
+	if hasResolution {
+		switch resolution[0] {
+		case "merge":
+		case "ignore":
+			merge = false
+		default:
+			return "", BadRequest(fmt.Errorf("invalid __resolution__ %s: expected merge or ignore", resolution[0]))
+		}
+	}
+
+	var conflict []string
+	if hasConflict {
+		for _, value := range onConflict {
+			for _, column := range strings.Split(value, ",") {
+				if column = strings.TrimSpace(column); column != "" {
+					conflict = append(conflict, column)
+				}
+			}
+		}
+	} else {
+		conflict = info.PrimaryKey
+	}
+	if len(conflict) == 0 {
+		return "", BadRequest(fmt.Errorf("table %s has no primary key, use __on_conflict__", info.Name))
+	}
+
+	quotedConflict := make([]string, len(conflict))
+	for i, column := range conflict {
+		quoted, err := info.QuoteColumn(column)
+		if err != nil {
+			return "", err
+		}
+		quotedConflict[i] = quoted
+	}
+
+	// Columns that are updated when the row already exists
+	var updates []string
+	if merge {
+		for _, column := range columns {
+			if !contains(conflict, column) {
+				updates = append(updates, column)
+			}
+		}
+	}
+
+	if config.Dbtype == "mysql" {
+		return mysqlUpsertClause(info, columns, quotedConflict, updates)
+	}
+
+	target := strings.Join(quotedConflict, ", ")
+	if len(updates) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", target), nil
+	}
+	sets := make([]string, len(updates))
+	for i, column := range updates {
+		quoted := config.QuoteIdent(column)
+		sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted)
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", target, strings.Join(sets, ", ")), nil
+}
+
+// mysqlUpsertClause builds the ON DUPLICATE KEY UPDATE clause. MySQL
+// resolves conflicts on any unique key, so the conflict columns are only
+// used for the no-op assignment of an ignore. When the auto increment
+// key is not inserted it is passed through LAST_INSERT_ID so that the
+// existing row can be read back.
+func mysqlUpsertClause(info *TableInfo, columns, quotedConflict, updates []string) (string, error) {
+	var sets []string
+	if len(info.PrimaryKey) == 1 && !contains(columns, info.PrimaryKey[0]) {
+		quoted := config.QuoteIdent(info.PrimaryKey[0])
+		sets = append(sets, fmt.Sprintf("%s = LAST_INSERT_ID(%s)", quoted, quoted))
+	}
+	for _, column := range updates {
+		quoted := config.QuoteIdent(column)
+		sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", quoted, quoted))
+	}
+	if len(sets) == 0 {
+		if len(quotedConflict) == 0 {
+			return "", errors.New("no column to resolve the conflict on")
+		}
+		sets = append(sets, fmt.Sprintf("%s = %s", quotedConflict[0], quotedConflict[0]))
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", "), nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// columnKind is the json representation of the values of a column
+type columnKind int
+
+const (
+	textColumn columnKind = iota
+	intColumn
+	uintColumn
+	floatColumn
+	decimalColumn
+	boolColumn
+	jsonColumn
+	binaryColumn
+	dateColumn
+	timestampColumn
+)
+
+// columnType is the representation of a column, the kind of the
+// elements for a PostgreSQL array
+type columnType struct {
+	kind  columnKind
+	array bool
+}
+
+// columnKinds maps the type names reported by the PostgreSQL and MySQL
+// drivers onto their kind. Other types are text.
+var columnKinds = map[string]columnKind{
+	"INT2":        intColumn,
+	"INT4":        intColumn,
+	"INT8":        intColumn,
+	"OID":         intColumn,
+	"TINYINT":     intColumn,
+	"SMALLINT":    intColumn,
+	"MEDIUMINT":   intColumn,
+	"INT":         intColumn,
+	"BIGINT":      intColumn,
+	"YEAR":        intColumn,
+	"FLOAT4":      floatColumn,
+	"FLOAT8":      floatColumn,
+	"FLOAT":       floatColumn,
+	"DOUBLE":      floatColumn,
+	"NUMERIC":     decimalColumn,
+	"DECIMAL":     decimalColumn,
+	"BOOL":        boolColumn,
+	"JSON":        jsonColumn,
+	"JSONB":       jsonColumn,
+	"BYTEA":       binaryColumn,
+	"BLOB":        binaryColumn,
+	"TINYBLOB":    binaryColumn,
+	"MEDIUMBLOB":  binaryColumn,
+	"LONGBLOB":    binaryColumn,
+	"BINARY":      binaryColumn,
+	"VARBINARY":   binaryColumn,
+	"BIT":         binaryColumn,
+	"GEOMETRY":    binaryColumn,
+	"DATE":        dateColumn,
+	"DATETIME":    timestampColumn,
+	"TIMESTAMP":   timestampColumn,
+	"TIMESTAMPTZ": timestampColumn,
+}
+
+// maxSafeInteger is the largest integer a javascript number holds
+// exactly
+const maxSafeInteger = 1<<53 - 1
+
+// resultTypes returns the representation of the columns of a result
+func resultTypes(rows *sql.Rows) ([]columnType, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]columnType, len(types))
+	for i, t := range types {
+		result[i] = typeOf(strings.ToUpper(t.DatabaseTypeName()))
+	}
+	return result, nil
+}
+
+// typeOf returns the representation of a database type. SQLite reports
+// the declared type of a column, which is mapped by its affinity.
+func typeOf(name string) columnType {
+	if config.Dbtype == "postgres" && strings.HasPrefix(name, "_") {
+		return columnType{kind: columnKinds[name[1:]], array: true}
+	}
+	if strings.HasPrefix(name, "UNSIGNED ") {
+		return columnType{kind: uintColumn}
+	}
+	if config.Dbtype != "sqlite3" {
+		return columnType{kind: columnKinds[name]}
+	}
+
+	switch {
+	case strings.Contains(name, "INT"):
+		return columnType{kind: intColumn}
+	case strings.Contains(name, "BOOL"):
+		return columnType{kind: boolColumn}
+	case strings.Contains(name, "CHAR"), strings.Contains(name, "CLOB"), strings.Contains(name, "TEXT"):
+		return columnType{kind: textColumn}
+	case strings.Contains(name, "BLOB"):
+		return columnType{kind: binaryColumn}
+	case strings.Contains(name, "REAL"), strings.Contains(name, "FLOA"), strings.Contains(name, "DOUB"):
+		return columnType{kind: floatColumn}
+	case name == "JSON", name == "DATE":
+		return columnType{kind: columnKinds[name]}
+	}
+	return columnType{kind: textColumn}
+}
+
+// convertValue converts a value scanned from the database into its json
+// representation: numbers, booleans, nested json, arrays, binary data as
+// base64 and times as RFC 3339
+func convertValue(value interface{}, t columnType) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return convertText(string(v), t, true)
+	case string:
+		return convertText(v, t, false)
+	case int64:
+		if t.kind == boolColumn {
+			return v != 0
+		}
+		return intValue(v)
+	case uint64:
+		if config.BigNumStrings && v > maxSafeInteger {
+			return strconv.FormatUint(v, 10)
+		}
+		return v
+	case time.Time:
+		if t.kind == dateColumn {
+			return v.Format(time.DateOnly)
+		}
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// convertText converts the text of a value. Raw text from the driver
+// that is not valid UTF-8 is binary data.
+func convertText(text string, t columnType, raw bool) interface{} {
+	if t.array {
+		if values, ok := parseArray(text, columnType{kind: t.kind}); ok {
+			return values
+		}
+		return text
+	}
+
+	switch t.kind {
+	case intColumn:
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return intValue(i)
+		}
+	case uintColumn:
+		if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return convertValue(u, t)
+		}
+	case floatColumn:
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f
+		}
+	case decimalColumn:
+		if config.BigNumStrings {
+			return text
+		}
+		if _, err := strconv.ParseFloat(text, 64); err == nil && json.Valid([]byte(text)) {
+			return json.Number(text)
+		}
+	case boolColumn:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b
+		}
+	case jsonColumn:
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	case binaryColumn:
+		if raw {
+			return base64.StdEncoding.EncodeToString([]byte(text))
+		}
+	case timestampColumn:
+		// MySQL without parseTime sends times as text
+		if ts, err := time.Parse("2006-01-02 15:04:05.999999999", text); err == nil {
+			return ts.Format(time.RFC3339Nano)
+		}
+	}
+
+	if raw && !utf8.ValidString(text) {
+		return base64.StdEncoding.EncodeToString([]byte(text))
+	}
+	return text
+}
+
+// intValue returns an integer, as a string beyond the integers a
+// javascript number holds when -big-numbers-as-strings is set
+func intValue(i int64) interface{} {
+	if config.BigNumStrings && (i > maxSafeInteger || i < -maxSafeInteger) {
+		return strconv.FormatInt(i, 10)
+	}
+	return i
+}
+
+// parseArray parses the text of a PostgreSQL array, e.g. {1,"a b",NULL},
+// converting its elements to the type of the column
+func parseArray(text string, elem columnType) ([]interface{}, bool) {
+	values, rest, ok := parseArrayItems(text, elem)
+	return values, ok && rest == ""
+}
+
+// parseArrayItems parses the array at the start of the text and returns
+// the text following it
+func parseArrayItems(text string, elem columnType) ([]interface{}, string, bool) {
+	if !strings.HasPrefix(text, "{") {
+		return nil, text, false
+	}
+	text = text[1:]
+	values := []interface{}{}
+	if strings.HasPrefix(text, "}") {
+		return values, text[1:], true
+	}
+
+	for {
+		var value interface{}
+		switch {
+		case strings.HasPrefix(text, "{"):
+			nested, rest, ok := parseArrayItems(text, elem)
+			if !ok {
+				return nil, text, false
+			}
+			value, text = nested, rest
+		case strings.HasPrefix(text, `"`):
+			var item strings.Builder
+			i := 1
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				item.WriteByte(text[i])
+			}
+			if i >= len(text) {
+				return nil, text, false
+			}
+			value, text = convertText(item.String(), elem, false), text[i+1:]
+		default:
+			end := strings.IndexAny(text, ",}")
+			if end < 0 {
+				return nil, text, false
+			}
+			if item := text[:end]; item != "NULL" {
+				value = convertText(item, elem, false)
+			}
+			text = text[end:]
+		}
+		values = append(values, value)
+
+		switch {
+		case strings.HasPrefix(text, "}"):
+			return values, text[1:], true
+		case strings.HasPrefix(text, ","):
+			text = text[1:]
+		default:
+			return nil, text, false
+		}
+	}
+}
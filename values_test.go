@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseArray(t *testing.T) {
+	tests := []struct {
+		text   string
+		kind   columnKind
+		values []interface{}
+		ok     bool
+	}{
+		{"{}", textColumn, []interface{}{}, true},
+		{"{1,2,3}", intColumn, []interface{}{int64(1), int64(2), int64(3)}, true},
+		{"{1,NULL}", intColumn, []interface{}{int64(1), nil}, true},
+		{`{a,"b c","NULL","d,e"}`, textColumn, []interface{}{"a", "b c", "NULL", "d,e"}, true},
+		{`{"say \"hi\"","a\\b"}`, textColumn, []interface{}{`say "hi"`, `a\b`}, true},
+		{"{{1,2},{3,4}}", intColumn, []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(3), int64(4)}}, true},
+		{"{t,f}", boolColumn, []interface{}{true, false}, true},
+		{"{1.50,2}", decimalColumn, []interface{}{json.Number("1.50"), json.Number("2")}, true},
+		{`{"{\"a\": 1}"}`, jsonColumn, []interface{}{json.RawMessage(`{"a": 1}`)}, true},
+		{"", textColumn, nil, false},
+		{"{1,2", intColumn, nil, false},
+		{`{"a}`, textColumn, nil, false},
+		{"{1,2}x", intColumn, nil, false},
+		{"[1:2]={1,2}", intColumn, nil, false},
+	}
+
+	for _, test := range tests {
+		values, ok := parseArray(test.text, columnType{kind: test.kind})
+		if ok != test.ok || (ok && !reflect.DeepEqual(values, test.values)) {
+			t.Errorf("parseArray(%q) = %#v, %v, want %#v, %v", test.text, values, ok, test.values, test.ok)
+		}
+	}
+}